@@ -59,8 +59,9 @@ func New(cfg interface{}) *APP {
 	return instance
 }
 
-func (app *APP) InitLog() {
-	log.Init(app.Config.Log)
+// InitLog 初始化日志，文件日志的路径不可用时返回错误
+func (app *APP) InitLog() error {
+	return log.Init(app.Config.Log)
 }
 
 func (app *APP) InitStat() {
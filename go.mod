@@ -1,6 +1,6 @@
 module github.com/plexsec/utils
 
-go 1.17
+go 1.18
 
 require (
 	github.com/Netflix/go-env v0.0.0-20210215222557-e437a7e7f9fb
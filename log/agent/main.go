@@ -33,11 +33,35 @@ func traceFunc(file string) {
 		new := atomic.LoadInt32(&count)
 		speed := new - last
 		last = new
-		fmt.Fprintf(f, "total: %d, speed: %d/s\n", new, speed)
+		s := rlog.GetStats()
+		fmt.Fprintf(f, "total: %d, speed: %d/s, dropped: %d, overwritten: %d, block timeouts: %d, spilled: %d, corrupted: %d, abandoned: %d\n",
+			new, speed, s.DroppedNewest, s.Overwritten, s.BlockTimeouts, s.Spilled, s.Corrupted, s.Abandoned)
 		time.Sleep(1 * time.Second)
 	}
 }
 
+// reportStats 每分钟报告一次有变化的计数：队列满时丢弃、覆盖或者写到本地文件的日志，跳过的损坏记录和写进程没有发布的记录
+func reportStats() {
+	last := rlog.GetStats()
+	for {
+		time.Sleep(time.Minute)
+		s := rlog.GetStats()
+		if s.DroppedNewest != last.DroppedNewest || s.Overwritten != last.Overwritten ||
+			s.BlockTimeouts != last.BlockTimeouts || s.Spilled != last.Spilled {
+			fmt.Printf("rlog queue overflow in last minute, dropped: %d, overwritten: %d, block timeouts: %d, spilled: %d\n",
+				s.DroppedNewest-last.DroppedNewest, s.Overwritten-last.Overwritten,
+				s.BlockTimeouts-last.BlockTimeouts, s.Spilled-last.Spilled)
+		}
+		if s.Corrupted != last.Corrupted {
+			fmt.Printf("rlog corrupt records skipped in last minute: %d\n", s.Corrupted-last.Corrupted)
+		}
+		if s.Abandoned != last.Abandoned {
+			fmt.Printf("rlog records abandoned by writers in last minute: %d\n", s.Abandoned-last.Abandoned)
+		}
+		last = s
+	}
+}
+
 var producer sarama.AsyncProducer
 var mutex = &sync.Mutex{}
 var connected = int32(0)
@@ -101,11 +125,20 @@ func initProducer() {
 }
 
 func main() {
-	err := rlog.Init()
+	// 和写日志的进程用同样的队列设置，由环境变量传过来
+	err := rlog.Init(rlog.OptionsFromEnv())
 	if err != nil {
 		fmt.Printf("init rlog error: %v\n", err)
 		os.Exit(-1)
 	}
+	info := rlog.Info()
+	fmt.Printf("rlog queue version %d capacity %d max message %d, created by pid %d at %v\n",
+		info.Version, info.Capacity, info.MaxMessage, info.Pid, info.Created)
+	for _, lane := range info.Lanes {
+		fmt.Printf("rlog lane min level %d capacity %d\n", lane.MinLevel, lane.Capacity)
+	}
+
+	go reportStats()
 
 	trace := os.Getenv("LOG_AGENT_TRACE")
 	if trace != "" {
@@ -116,14 +149,9 @@ func main() {
 
 	const remoteTopic = "logstash"
 
-	var pid string
-	if cid := os.Getenv("HOSTNAME"); cid != "" {
-		pid = fmt.Sprintf("%s|", cid)
-	} else {
-		pid = fmt.Sprintf("%d|", os.Getpid())
-	}
+	// 和旧版本一样的一行：主机|时间|级别|模块|文件:行号 函数|内容，时间格式由写日志的进程传过来
+	lf := rlog.LineFormatFromEnv()
 
-	sleepIndex := 0
 	for {
 		connected := atomic.LoadInt32(&connected)
 		if connected <= 0 {
@@ -131,25 +159,16 @@ func main() {
 			continue
 		}
 
-		module, msg, err := rlog.Read()
+		// 队列空时等写日志的进程唤醒，超时后回去检查连接
+		r, err := rlog.ReadWait(time.Second)
 		if err != nil {
-			if err == rlog.ErrorQueryEmpty {
-				// 队列空，等待一定时间后重试
-				time.Sleep(100 * time.Millisecond)
-				sleepIndex++
-				continue
-			} else if err == rlog.ErrorCasError {
-				// 直接重试
-				sleepIndex = 0
-				continue
-			}
+			continue
 		}
-		sleepIndex = 0
 		pm := &sarama.ProducerMessage{}
 		pm.Topic = remoteTopic
-		pm.Key = sarama.StringEncoder(module)
+		pm.Key = sarama.StringEncoder(r.Module)
 		pm.Partition = 1
-		pm.Value = sarama.ByteEncoder(pid + msg)
+		pm.Value = sarama.ByteEncoder(lf.AppendLine(nil, r))
 		producer.Input() <- pm
 		atomic.AddInt32(&count, 1)
 	}
@@ -0,0 +1,187 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// BufferOptions 请求日志缓存的设置
+type BufferOptions struct {
+	Module     string  // 模块名，为空时使用默认模块名
+	Level      Level   // 该级别及以下的日志先缓存，默认DEBUG
+	Max        int     // 最多缓存的条数，超过时丢弃最早的，默认1000
+	SampleRate float64 // 请求成功时也输出的比例，0到1
+}
+
+// Buffer 一个请求内的日志缓存
+// 低级别的日志先缓存起来，请求出错或者被采样时才按原来的时间和调用位置输出，否则丢弃
+// 输出时主文件日志和设置了Buffered的文件日志不看最低级别，其他输出仍按各自的级别过滤
+// 其他级别的日志直接输出。nil的Buffer所有日志都直接输出
+type Buffer struct {
+	module  string
+	level   Level
+	max     int
+	sampled bool
+
+	mu      sync.Mutex
+	entries []Entry
+	dropped int
+}
+
+// NewBuffer 创建请求日志缓存
+func NewBuffer(opts *BufferOptions) *Buffer {
+	b := &Buffer{
+		level: DEBUG,
+		max:   1000,
+	}
+	if opts != nil {
+		b.module = opts.Module
+		if opts.Level != OFF {
+			b.level = opts.Level
+		}
+		if opts.Max > 0 {
+			b.max = opts.Max
+		}
+		b.sampled = opts.SampleRate > 0 && rand.Float64() < opts.SampleRate
+	}
+	return b
+}
+
+type bufferKey struct{}
+
+// NewContext 把缓存放到context里
+func NewContext(ctx context.Context, b *Buffer) context.Context {
+	return context.WithValue(ctx, bufferKey{}, b)
+}
+
+// FromContext 取context里的缓存，没有时返回nil，nil的Buffer可以直接用于打印
+func FromContext(ctx context.Context) *Buffer {
+	b, _ := ctx.Value(bufferKey{}).(*Buffer)
+	return b
+}
+
+// Sampled 请求成功时是否也输出
+func (b *Buffer) Sampled() bool {
+	return b != nil && b.sampled
+}
+
+// Finish 请求结束，err不为空或者被采样时输出缓存的日志，否则丢弃
+func (b *Buffer) Finish(err error) {
+	if err != nil || b.Sampled() {
+		b.Flush()
+	} else {
+		b.Discard()
+	}
+}
+
+// Flush 按原来的时间和调用位置输出缓存的日志
+func (b *Buffer) Flush() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	entries, dropped := b.entries, b.dropped
+	b.entries, b.dropped = nil, 0
+	b.mu.Unlock()
+
+	l := load()
+	if dropped > 0 && len(entries) > 0 {
+		e := entries[0]
+		e.Level = WARN
+		emit(l, &e, &message{
+			format: fmt.Sprintf("%d earlier buffered lines dropped", dropped),
+			raw:    true,
+		}, true)
+	}
+	for i := range entries {
+		e := &entries[i]
+		emit(l, e, &message{format: e.Message, raw: true}, true)
+	}
+}
+
+// Discard 丢弃缓存的日志
+func (b *Buffer) Discard() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.entries, b.dropped = nil, 0
+	b.mu.Unlock()
+}
+
+// log 缓存或者直接输出，skip为调用log的函数之上还要跳过的调用层数
+// 缓存的日志只看缓存的级别，输出时见Buffer
+func (b *Buffer) log(level Level, skip int, format string, v []interface{}) {
+	module := ""
+	if b != nil {
+		module = b.module
+	}
+
+	l := load()
+	if b == nil || level > b.level {
+		if level >= l.minLevel {
+			write(l, module, level, skip, &message{format: format, args: v})
+		}
+		return
+	}
+
+	if module == "" {
+		module = l.module
+	}
+
+	e := Entry{
+		Time:    l.clock.Now(),
+		Level:   level,
+		Module:  module,
+		Message: fmt.Sprintf(format, v...),
+	}
+	e.File, e.Line, e.Func = caller(skip + 1)
+
+	b.mu.Lock()
+	if len(b.entries) >= b.max {
+		copy(b.entries, b.entries[1:])
+		b.entries = b.entries[:len(b.entries)-1]
+		b.dropped++
+	}
+	b.entries = append(b.entries, e)
+	b.mu.Unlock()
+}
+
+// Fatal 大于等于FATAL时都打印
+func (b *Buffer) Fatal(format string, v ...interface{}) {
+	b.log(FATAL, 1, format, v)
+}
+
+// Critical 大于等于CRITICAL时都打印
+func (b *Buffer) Critical(format string, v ...interface{}) {
+	b.log(CRITICAL, 1, format, v)
+}
+
+// Error 大于等于ERROR时都打印
+func (b *Buffer) Error(format string, v ...interface{}) {
+	b.log(ERROR, 1, format, v)
+}
+
+// Warn 大于等于WARN时都打印
+func (b *Buffer) Warn(format string, v ...interface{}) {
+	b.log(WARN, 1, format, v)
+}
+
+// Info 大于等于INFO时都打印
+func (b *Buffer) Info(format string, v ...interface{}) {
+	b.log(INFO, 1, format, v)
+}
+
+// Debug 大于等于DEBUG时缓存，请求出错时才打印
+func (b *Buffer) Debug(format string, v ...interface{}) {
+	b.log(DEBUG, 1, format, v)
+}
+
+// Verbose 大于等于VERBOSE时缓存，请求出错时才打印
+func (b *Buffer) Verbose(format string, v ...interface{}) {
+	b.log(VERBOSE, 1, format, v)
+}
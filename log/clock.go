@@ -0,0 +1,119 @@
+package log
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/plexsec/utils/log/rlog"
+)
+
+// Clock 日志取时间用的时钟，测试时可以替换
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// 默认的时间格式，固定6位小数，各个主机上宽度一致
+const defaultTimeLayout = "2006-01-02 15:04:05.000000"
+
+// timeFormat 日志里时间的格式
+type timeFormat struct {
+	layout string         // time.Format的格式，为空时输出epoch
+	unit   time.Duration  // epoch的单位
+	loc    *time.Location // 时区
+}
+
+var defaultTimeFormat = timeFormat{
+	layout: defaultTimeLayout,
+	loc:    time.Local,
+}
+
+// newTimeFormat 解析时间格式
+// 支持rfc3339、rfc3339nano、epoch(秒)、epochmillis、epochmicros、epochnanos，其他的当作time.Format的格式
+func newTimeFormat(format string, loc *time.Location) timeFormat {
+	f := timeFormat{loc: loc}
+	switch strings.ToLower(format) {
+	case "":
+		f.layout = defaultTimeLayout
+	case "rfc3339":
+		f.layout = time.RFC3339
+	case "rfc3339nano":
+		f.layout = time.RFC3339Nano
+	case "epoch":
+		f.unit = time.Second
+	case "epochmillis":
+		f.unit = time.Millisecond
+	case "epochmicros":
+		f.unit = time.Microsecond
+	case "epochnanos":
+		f.unit = time.Nanosecond
+	default:
+		f.layout = format
+	}
+	return f
+}
+
+// lineFormat 转成rlog的格式，agent按同样的时间格式输出
+func (f *timeFormat) lineFormat() *rlog.LineFormat {
+	return &rlog.LineFormat{Layout: f.layout, Unit: f.unit, Loc: f.loc}
+}
+
+// appendTo 写时间
+func (f *timeFormat) appendTo(buf *bytes.Buffer, t time.Time) {
+	var tmp [64]byte
+	if f.layout == "" {
+		buf.Write(strconv.AppendInt(tmp[:0], t.UnixNano()/int64(f.unit), 10))
+		return
+	}
+
+	buf.Write(t.In(f.loc).AppendFormat(tmp[:0], f.layout))
+}
+
+// newLocation 解析时区，支持local、utc和时区名如Asia/Shanghai
+func newLocation(zone string) (*time.Location, error) {
+	switch strings.ToLower(zone) {
+	case "", "local":
+		return time.Local, nil
+	case "utc":
+		return time.UTC, nil
+	default:
+		return time.LoadLocation(zone)
+	}
+}
+
+// SetClock 设置取时间的时钟，为nil时恢复系统时钟
+func SetClock(c Clock) {
+	if c == nil {
+		c = systemClock{}
+	}
+	update(func(l *logger) {
+		l.clock = c
+	})
+}
+
+// SetTimeFormat 设置时间格式，见newTimeFormat
+func SetTimeFormat(format string) {
+	update(func(l *logger) {
+		l.timeFormat = newTimeFormat(format, l.timeFormat.loc)
+	})
+}
+
+// SetTimeZone 设置时间的时区，local(默认)、utc或者时区名如Asia/Shanghai
+func SetTimeZone(zone string) error {
+	loc, err := newLocation(zone)
+	if err != nil {
+		return err
+	}
+
+	update(func(l *logger) {
+		l.timeFormat.loc = loc
+	})
+	return nil
+}
@@ -0,0 +1,649 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 刷盘策略
+const (
+	syncNever    = iota
+	syncLevel    // 级别大于等于syncLevel的日志写完就刷盘
+	syncInterval // 每隔syncInterval刷盘
+)
+
+// 写文件失败时的去处
+const (
+	fallbackNone   = iota
+	fallbackStderr // 写到标准错误
+	fallbackRing   // 存在内存里，恢复后补写到文件
+)
+
+// 写文件失败后，每隔这么久重试一次
+const retryInterval = time.Second
+
+type fileLogger struct {
+	on         bool
+	name       string //日志文件名
+	level      Level
+	verbosity  int             // 级别写成"V3"时为3，否则为-1
+	buffered   bool            // Buffer输出缓存的日志时不看最低级别
+	maxLevel   Level           // 最高级别，OFF表示不限制
+	modules    map[string]bool // 只写这些模块的日志，为空时不过滤
+	maxSize    int64
+	maxFileNum int
+
+	sync         int
+	syncLevel    Level
+	syncInterval time.Duration
+	fallback     int
+	ringSize     int
+
+	rules rules
+
+	header    bool // 新文件开头写文件头，正常滚动时写文件尾
+	createDir bool
+	fileMode  os.FileMode
+	dirMode   os.FileMode
+	chmod     bool // 设置了权限，新建时不受umask影响
+	uid, gid  int  // 新建文件和目录的用户和组，-1表示不修改
+
+	state *fileState // 运行时状态，配置更新时复制出来的fileLogger共用同一个
+}
+
+// newFileLogger 按配置创建文件日志，用户或组不存在或者过滤规则有错时返回错误，但仍然返回可用的文件日志
+func newFileLogger(cfg *FileLogConfig) (*fileLogger, error) {
+	f := &fileLogger{
+		on:         true,
+		name:       cfg.Path,
+		level:      newLevel(cfg.Level),
+		verbosity:  sinkVerbosity(cfg.Level),
+		buffered:   cfg.Buffered,
+		maxSize:    fileSize(cfg.MaxSize),
+		maxFileNum: fileNum(cfg.MaxFileNum),
+		ringSize:   cfg.RingSize,
+		header:     cfg.Header,
+		createDir:  cfg.CreateDir,
+		fileMode:   0666,
+		dirMode:    0755,
+		uid:        -1,
+		gid:        -1,
+		state:      &fileState{},
+	}
+	if cfg.MaxLevel != nil {
+		f.maxLevel = newLevel(cfg.MaxLevel)
+	}
+	if len(cfg.Modules) > 0 {
+		f.modules = make(map[string]bool, len(cfg.Modules))
+		for _, m := range cfg.Modules {
+			f.modules[m] = true
+		}
+	}
+
+	switch strings.ToLower(cfg.Sync) {
+	case "level":
+		f.sync = syncLevel
+		f.syncLevel = ERROR
+		if cfg.SyncLevel != nil {
+			f.syncLevel = newLevel(cfg.SyncLevel)
+		}
+	case "interval":
+		f.sync = syncInterval
+		f.syncInterval = cfg.SyncInterval
+		if f.syncInterval <= 0 {
+			f.syncInterval = time.Second
+		}
+	}
+
+	switch strings.ToLower(cfg.Fallback) {
+	case "stderr":
+		f.fallback = fallbackStderr
+	case "ring":
+		f.fallback = fallbackRing
+	}
+	if f.ringSize <= 0 {
+		f.ringSize = 1000
+	}
+
+	if cfg.FileMode != 0 || cfg.DirMode != 0 {
+		f.chmod = true
+	}
+	if cfg.FileMode != 0 {
+		f.fileMode = cfg.FileMode.Perm()
+	}
+	if cfg.DirMode != 0 {
+		f.dirMode = cfg.DirMode.Perm()
+	}
+
+	var err, oerr error
+	f.rules, err = newRules(cfg.Rules)
+	if f.uid, f.gid, oerr = lookupOwner(cfg.Owner, cfg.Group); err == nil {
+		err = oerr
+	}
+	return f, err
+}
+
+// SinkError 文件日志写失败或者恢复时传给错误回调
+// 磁盘满或者IO错误时可以用errors.Is(e.Err, syscall.ENOSPC)判断
+type SinkError struct {
+	Path string
+	Err  error // 为nil表示已经恢复
+}
+
+func (e *SinkError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("log file %s recovered", e.Path)
+	}
+	return fmt.Sprintf("log file %s: %v", e.Path, e.Err)
+}
+
+func (e *SinkError) Unwrap() error {
+	return e.Err
+}
+
+// SetErrorHandler 设置文件日志写失败和恢复时的回调，每次失败只在第一次出错时回调
+// 回调在写日志的goroutine里调用，不在文件锁里，可以打日志
+func SetErrorHandler(fn func(e *SinkError)) {
+	update(func(l *logger) {
+		l.onError = fn
+	})
+}
+
+// 每写这么多行或者隔这么久检查一次是否要滚动，以及文件是否被别的进程滚动了
+const (
+	checkLines    = 1000
+	checkInterval = time.Second
+)
+
+// fileState 文件日志的运行时状态
+type fileState struct {
+	mu        sync.Mutex
+	f         *os.File
+	name      string // 打开的文件名
+	dev, ino  uint64 // 打开的文件，用于判断文件是否被别的进程滚动了
+	count     int
+	lastCheck time.Time
+	lastSync  time.Time
+	dirty     bool        // 有还没刷盘的日志
+	syncTimer *time.Timer // 按间隔刷盘时，间隔到了还没有新日志也要刷盘
+
+	failed   bool      // 写失败了，在重试
+	diskErr  bool      // 失败是因为磁盘满或者IO错误，失败期间的日志按设置写到fallback
+	failedAt time.Time // 上次失败的时间，隔retryInterval再重试
+	ring     [][]byte  // fallbackRing时失败期间的日志
+}
+
+// clone 复制一份配置用于修改，运行时状态共用
+func (f *fileLogger) clone() *fileLogger {
+	c := *f
+	return &c
+}
+
+// accept 判断该文件是否要写入指定模块和级别的日志
+func (f *fileLogger) accept(module string, level Level) bool {
+	if !f.on || !f.level.log(level) && (f.level == OFF || !f.rules.mayKeep(level)) {
+		return false
+	}
+	return f.route(module, level)
+}
+
+// route 按最高级别和模块判断是否写入，Buffer输出缓存的日志时buffered的文件不看最低级别
+func (f *fileLogger) route(module string, level Level) bool {
+	if f.maxLevel != OFF && level > f.maxLevel {
+		return false
+	}
+
+	if len(f.modules) > 0 && !f.modules[module] {
+		return false
+	}
+
+	return true
+}
+
+func outputToFile(l *logger, fl *fileLogger, level Level, b []byte) {
+	if fl.name == "" {
+		return
+	}
+
+	// 回调不能在锁里调用，回调里可能会打日志
+	if e := fl.state.write(l, fl, level, b); e != nil && l.onError != nil {
+		l.onError(e)
+	}
+}
+
+// write 写一行日志，失败或者恢复时返回要回调的错误
+func (st *fileState) write(l *logger, fl *fileLogger, level Level, b []byte) *SinkError {
+	// 同一个文件的写入和滚动要串行，否则多个goroutine会同时改名
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var notice *SinkError
+	if st.failed {
+		// 换了文件名时马上重试
+		if st.name == fl.name && time.Since(st.failedAt) < retryInterval {
+			st.fallbackWrite(fl, b)
+			return nil
+		}
+		if err := st.recover(l, fl); err != nil {
+			st.failedAt = time.Now()
+			st.diskErr = isDiskError(err)
+			st.fallbackWrite(fl, b)
+			return nil
+		}
+		notice = &SinkError{Path: fl.name}
+	}
+
+	if st.f == nil || st.name != fl.name {
+		if err := st.open(l, fl); err != nil {
+			notice = st.fail(fl, err)
+			st.fallbackWrite(fl, b)
+			return notice
+		}
+	}
+
+	if _, err := st.f.Write(b); err != nil {
+		notice = st.fail(fl, err)
+		st.fallbackWrite(fl, b)
+		return notice
+	}
+	countFile(fl.name)
+
+	if err := st.sync(fl, level); err != nil {
+		return st.fail(fl, err)
+	}
+
+	st.count++
+	if st.count >= checkLines || time.Since(st.lastCheck) >= checkInterval {
+		st.count = 0
+		st.lastCheck = time.Now()
+		st.check(l, fl)
+	}
+
+	return notice
+}
+
+// sync 按刷盘策略刷盘
+func (st *fileState) sync(fl *fileLogger, level Level) error {
+	switch fl.sync {
+	case syncLevel:
+		if level < fl.syncLevel {
+			return nil
+		}
+	case syncInterval:
+		if since := time.Since(st.lastSync); since < fl.syncInterval {
+			st.dirty = true
+			if st.syncTimer == nil {
+				st.syncTimer = time.AfterFunc(fl.syncInterval-since, st.syncDirty)
+			}
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	st.lastSync = time.Now()
+	st.dirty = false
+	return st.f.Sync()
+}
+
+// syncDirty 间隔到了还有没刷盘的日志时刷盘，出错时下一行日志写失败时再处理
+func (st *fileState) syncDirty() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.syncTimer = nil
+	if !st.dirty || st.f == nil {
+		return
+	}
+	st.lastSync = time.Now()
+	st.dirty = false
+	if err := st.f.Sync(); err != nil {
+		atomic.AddInt64(&metrics.writeErrors, 1)
+	}
+}
+
+// isDiskError 磁盘满或者IO错误，这时才写到fallback
+func isDiskError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EIO)
+}
+
+// fail 记录失败，关掉文件等下次重试时重新打开，只有第一次失败时返回要回调的错误
+func (st *fileState) fail(fl *fileLogger, err error) *SinkError {
+	atomic.AddInt64(&metrics.writeErrors, 1)
+	st.close()
+	st.name = fl.name
+	st.failedAt = time.Now()
+	st.diskErr = isDiskError(err)
+	if st.failed {
+		return nil
+	}
+	st.failed = true
+	return &SinkError{Path: fl.name, Err: err}
+}
+
+// recover 重新打开文件，先补写失败期间存在内存里的日志
+func (st *fileState) recover(l *logger, fl *fileLogger) error {
+	if err := st.open(l, fl); err != nil {
+		return err
+	}
+
+	for len(st.ring) > 0 {
+		if _, err := st.f.Write(st.ring[0]); err != nil {
+			st.close()
+			return err
+		}
+		countFile(fl.name)
+		st.ring = st.ring[1:]
+	}
+
+	st.ring = nil
+	st.failed = false
+	return nil
+}
+
+// fallbackWrite 磁盘满或者IO错误时按设置写到标准错误或者存在内存里，其他错误时丢弃
+func (st *fileState) fallbackWrite(fl *fileLogger, b []byte) {
+	fallback := fl.fallback
+	if !st.diskErr {
+		fallback = fallbackNone
+	}
+	switch fallback {
+	case fallbackStderr:
+		os.Stderr.Write(b)
+	case fallbackRing:
+		if len(st.ring) >= fl.ringSize {
+			st.ring = st.ring[1:]
+			atomic.AddInt64(&metrics.fallbackDrops, 1)
+		}
+		st.ring = append(st.ring, append([]byte(nil), b...))
+	default:
+		atomic.AddInt64(&metrics.fallbackDrops, 1)
+	}
+}
+
+// open 打开文件，已经打开的先关掉，新建的文件按设置先写文件头
+func (st *fileState) open(l *logger, fl *fileLogger) error {
+	st.close()
+
+	name := fl.name
+	f, created, err := fl.create(name, os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		return err
+	}
+	if created {
+		if err := fl.setOwner(name); err != nil {
+			atomic.AddInt64(&metrics.writeErrors, 1)
+		}
+	}
+
+	var sys syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &sys); err != nil {
+		f.Close()
+		return err
+	}
+
+	st.f = f
+	st.name = name
+	st.dev, st.ino = uint64(sys.Dev), sys.Ino
+
+	if created && fl.header {
+		st.writeRecord(fileHeader(l, fl))
+	}
+	return nil
+}
+
+// writeRecord 写文件头和文件尾，写失败时不影响日志，下一行日志写失败时再处理
+func (st *fileState) writeRecord(b []byte) {
+	if _, err := st.f.Write(b); err != nil {
+		atomic.AddInt64(&metrics.writeErrors, 1)
+	}
+}
+
+func (st *fileState) close() {
+	if st.f != nil {
+		// 按间隔刷盘时关掉之前把没刷盘的刷掉
+		if st.dirty {
+			st.f.Sync()
+			st.dirty = false
+		}
+		st.f.Close()
+		st.f = nil
+	}
+}
+
+// moved 判断文件名现在指向的是否还是打开的文件，返回当前文件的大小
+func (st *fileState) moved() (bool, int64) {
+	var sys syscall.Stat_t
+	if err := syscall.Stat(st.name, &sys); err != nil {
+		return true, 0
+	}
+	return uint64(sys.Dev) != st.dev || sys.Ino != st.ino, sys.Size
+}
+
+// check 文件被别的进程滚动了就重新打开，超过大小时滚动
+// 多个进程写同一个文件时，用文件名加.lock的文件加锁，只有拿到锁的进程滚动
+func (st *fileState) check(l *logger, fl *fileLogger) {
+	moved, size := st.moved()
+	if moved {
+		if err := st.open(l, fl); err != nil {
+			atomic.AddInt64(&metrics.writeErrors, 1)
+		}
+		return
+	}
+
+	if size < fl.maxSize || fl.maxFileNum < 2 {
+		return
+	}
+
+	lock, err := lockFile(fl)
+	if err != nil {
+		// 别的进程正在滚动，下次检查时会发现文件变了再重新打开
+		return
+	}
+	defer unlockFile(lock)
+
+	// 拿到锁之后再检查一次，可能别的进程刚刚滚动完
+	moved, size = st.moved()
+	if !moved && size >= fl.maxSize {
+		if fl.header {
+			st.writeRecord(fileTrailer(l, fl))
+		}
+		if err := shiftFiles(fl); err != nil {
+			atomic.AddInt64(&metrics.writeErrors, 1)
+		} else {
+			atomic.AddInt64(&metrics.rotations, 1)
+		}
+	}
+
+	if err := st.open(l, fl); err != nil {
+		atomic.AddInt64(&metrics.writeErrors, 1)
+	}
+}
+
+// lockFile 非阻塞地对日志文件对应的锁文件加排他锁，锁文件不存在时创建
+func lockFile(fl *fileLogger) (*os.File, error) {
+	name := fl.name + ".lock"
+	f, created, err := fl.create(name, os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		fl.setOwner(name)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func unlockFile(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	f.Close()
+}
+
+// shiftFiles 滚动文件，name.N-1改名为name.N，最后name改名为name.1
+func shiftFiles(fl *fileLogger) error {
+	for i := fl.maxFileNum - 2; i >= 0; i-- {
+		var nameOld string
+		if i == 0 {
+			nameOld = fl.name
+		} else {
+			nameOld = fmt.Sprintf("%s.%d", fl.name, i)
+		}
+		fileInfo, err := os.Stat(nameOld)
+		if err != nil {
+			continue
+		}
+		if fileInfo.IsDir() {
+			continue
+		}
+		nameNew := fmt.Sprintf("%s.%d", fl.name, i+1)
+		if err := os.Rename(nameOld, nameNew); err != nil && i == 0 {
+			return err
+		}
+	}
+	return nil
+}
+
+// create 打开文件，不存在时按设置的权限创建，设置了CreateDir时先创建目录，created表示是新建的
+func (fl *fileLogger) create(name string, flag int) (f *os.File, created bool, err error) {
+	// 打开和创建之间文件可能被别的进程创建或者滚动走，重试几次
+	for i := 0; i < 3; i++ {
+		f, err = os.OpenFile(name, flag|os.O_CREATE|os.O_EXCL, fl.fileMode)
+		if err == nil {
+			if fl.chmod {
+				f.Chmod(fl.fileMode)
+			}
+			return f, true, nil
+		}
+
+		if os.IsExist(err) {
+			f, err = os.OpenFile(name, flag, 0)
+			if !os.IsNotExist(err) {
+				return f, false, err
+			}
+			continue
+		}
+
+		if !os.IsNotExist(err) || !fl.createDir {
+			return nil, false, err
+		}
+		if err = fl.mkdir(filepath.Dir(name)); err != nil {
+			return nil, false, err
+		}
+	}
+	return nil, false, err
+}
+
+// mkdir 创建目录和不存在的上级目录，新建的目录按设置修改权限和用户
+func (fl *fileLogger) mkdir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err == nil {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := fl.mkdir(parent); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Mkdir(dir, fl.dirMode); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fl.chmod {
+		if err := os.Chmod(dir, fl.dirMode); err != nil {
+			return err
+		}
+	}
+	return fl.setOwner(dir)
+}
+
+// setOwner 按设置修改新建的文件或目录的用户和组
+func (fl *fileLogger) setOwner(name string) error {
+	if fl.uid < 0 && fl.gid < 0 {
+		return nil
+	}
+	return os.Chown(name, fl.uid, fl.gid)
+}
+
+// validate 启动时检查文件是否可写，设置了CreateDir时创建目录
+func (fl *fileLogger) validate() error {
+	dir := filepath.Dir(fl.name)
+	if fl.createDir {
+		if err := fl.mkdir(dir); err != nil {
+			return err
+		}
+	}
+	if fi, err := os.Stat(dir); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return &os.PathError{Op: "open", Path: dir, Err: syscall.ENOTDIR}
+	}
+
+	// 文件不存在时只检查目录是否可写，留到第一次写日志时创建，好写文件头
+	f, err := os.OpenFile(fl.name, os.O_WRONLY|os.O_APPEND, 0)
+	if os.IsNotExist(err) {
+		if err := syscall.Access(dir, 2|1); err != nil { // W_OK|X_OK
+			return &os.PathError{Op: "open", Path: fl.name, Err: err}
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// lookupOwner 解析用户和组，可以是名字或者id，为空时返回-1表示不修改
+func lookupOwner(owner, group string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if owner != "" {
+		id := owner
+		if _, e := strconv.Atoi(owner); e != nil {
+			u, e := user.Lookup(owner)
+			if e != nil {
+				return -1, -1, e
+			}
+			id = u.Uid
+		}
+		if uid, err = strconv.Atoi(id); err != nil {
+			return -1, -1, err
+		}
+	}
+
+	if group != "" {
+		id := group
+		if _, e := strconv.Atoi(group); e != nil {
+			g, e := user.LookupGroup(group)
+			if e != nil {
+				return -1, -1, e
+			}
+			id = g.Gid
+		}
+		if gid, err = strconv.Atoi(id); err != nil {
+			return -1, -1, err
+		}
+	}
+	return uid, gid, nil
+}
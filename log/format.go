@@ -0,0 +1,58 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// message 日志内容，优先用hex，其次fn，最后用format和args格式化
+type message struct {
+	format string
+	args   []interface{}
+	raw    bool // format是已经格式化好的内容
+	fn     func() string
+	hex    *hexDump
+	cond   bool // V(n)打的日志
+	v      int  // V(n)的n
+}
+
+// appendTo 把日志内容写到buf
+func (m *message) appendTo(buf *bytes.Buffer) {
+	switch {
+	case m.hex != nil:
+		m.hex.appendTitle(buf)
+		buf.WriteByte('\n')
+		m.hex.appendTable(buf)
+	case m.fn != nil:
+		buf.WriteString(m.fn())
+	case m.raw || len(m.args) == 0 && strings.IndexByte(m.format, '%') < 0:
+		buf.WriteString(m.format)
+	default:
+		fmt.Fprintf(buf, m.format, m.args...)
+	}
+}
+
+// appendEntry 写一行日志：时间|级别|模块|文件:行号 函数|内容
+func (l *logger) appendEntry(buf *bytes.Buffer, e *Entry, msg []byte) {
+	l.timeFormat.appendTo(buf, e.Time)
+	buf.WriteByte('|')
+	buf.WriteString(e.Level.name())
+	buf.WriteByte('|')
+	buf.WriteString(e.Module)
+	buf.WriteByte('|')
+	buf.WriteString(e.File)
+	buf.WriteByte(':')
+	appendInt(buf, int64(e.Line))
+	buf.WriteByte(' ')
+	buf.WriteString(e.Func)
+	buf.WriteByte('|')
+	buf.Write(msg)
+	buf.WriteByte('\n')
+}
+
+func appendInt(buf *bytes.Buffer, n int64) {
+	var num [20]byte
+	buf.Write(strconv.AppendInt(num[:0], n, 10))
+}
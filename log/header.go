@@ -0,0 +1,81 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// Version 写在文件头里的版本号，可以在编译时用-ldflags "-X github.com/plexsec/utils/log.Version=1.2.3"设置
+// 为空时取编译信息里主模块的版本
+var Version string
+
+// 进程启动时间，近似为该包初始化的时间
+var startTime = time.Now()
+
+func buildVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// fileHeader 新文件开头的记录，有模块、进程号、主机名、版本、启动时间和该文件的日志配置
+func fileHeader(l *logger, fl *fileLogger) []byte {
+	host, _ := os.Hostname()
+	return fileRecord(l, fmt.Sprintf("log file header: module=%s pid=%d host=%s version=%s start=%s config={%s}",
+		l.module, os.Getpid(), host, buildVersion(), startTime.Format(time.RFC3339), fl.describe()))
+}
+
+// fileTrailer 正常滚动时文件末尾的记录
+func fileTrailer(l *logger, fl *fileLogger) []byte {
+	return fileRecord(l, fmt.Sprintf("log file trailer: pid=%d rotated to %s.1", os.Getpid(), fl.name))
+}
+
+// fileRecord 按日志格式生成一条INFO的记录，调用位置为写文件头或文件尾的函数
+func fileRecord(l *logger, msg string) []byte {
+	e := Entry{
+		Time:   l.clock.Now(),
+		Level:  INFO,
+		Module: l.module,
+	}
+	e.File, e.Line, e.Func = caller(1)
+
+	var buf bytes.Buffer
+	l.appendEntry(&buf, &e, []byte(msg))
+	return buf.Bytes()
+}
+
+// describe 文件日志实际生效的配置
+func (fl *fileLogger) describe() string {
+	modules := make([]string, 0, len(fl.modules))
+	for m := range fl.modules {
+		modules = append(modules, m)
+	}
+	sort.Strings(modules)
+
+	sync := "never"
+	switch fl.sync {
+	case syncLevel:
+		sync = "level>=" + fl.syncLevel.name()
+	case syncInterval:
+		sync = "every " + fl.syncInterval.String()
+	}
+
+	fallback := "none"
+	switch fl.fallback {
+	case fallbackStderr:
+		fallback = "stderr"
+	case fallbackRing:
+		fallback = fmt.Sprintf("ring(%d)", fl.ringSize)
+	}
+
+	return fmt.Sprintf("path=%s level=%s max_level=%s modules=%v max_size=%d max_file_num=%d sync=%s fallback=%s",
+		fl.name, fl.level.name(), fl.maxLevel.name(), modules, fl.maxSize, fl.maxFileNum, sync, fallback)
+}
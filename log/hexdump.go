@@ -0,0 +1,120 @@
+package log
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/plexsec/utils/log/rlog"
+)
+
+const colTitle = "__________00_01_02_03_04_05_06_07__08_09_0A_0B_0C_0D_0E_0F"
+
+// 默认最多打印的字节数
+const defaultHexDumpMax = 4096
+
+// hexDump 要打印的二进制数据
+type hexDump struct {
+	title string
+	data  []byte
+	max   int // 最多打印的字节数，超过的截断
+}
+
+func (h *hexDump) shown() []byte {
+	if h.max > 0 && len(h.data) > h.max {
+		return h.data[:h.max]
+	}
+	return h.data
+}
+
+func (h *hexDump) appendTitle(buf *bytes.Buffer) {
+	buf.WriteString(h.title)
+	buf.WriteString(" len=")
+	appendInt(buf, int64(len(h.data)))
+}
+
+// appendTable 写偏移/十六进制/ASCII表格，每行16字节
+func (h *hexDump) appendTable(buf *bytes.Buffer) {
+	const upper = "0123456789ABCDEF"
+
+	buf.WriteString(colTitle)
+	data := h.shown()
+	for off := 0; off < len(data); off += 16 {
+		buf.WriteByte('\n')
+		for shift := 28; shift >= 0; shift -= 4 {
+			buf.WriteByte(upper[(off>>uint(shift))&0xF])
+		}
+		buf.WriteString("  ")
+
+		row := data[off:]
+		if len(row) > 16 {
+			row = row[:16]
+		}
+		for i := 0; i < 16; i++ {
+			if i == 8 {
+				buf.WriteByte(' ')
+			}
+			if i < len(row) {
+				buf.WriteByte(upper[row[i]>>4])
+				buf.WriteByte(upper[row[i]&0xF])
+			} else {
+				buf.WriteString("  ")
+			}
+			buf.WriteByte(' ')
+		}
+
+		buf.WriteString(" |")
+		for _, c := range row {
+			if c < 0x20 || c > 0x7E {
+				c = '.'
+			}
+			buf.WriteByte(c)
+		}
+		buf.WriteByte('|')
+	}
+
+	if n := len(h.data) - len(data); n > 0 {
+		buf.WriteString("\n... truncated ")
+		appendInt(buf, int64(n))
+		buf.WriteString(" bytes")
+	}
+}
+
+// fields 远程日志里以结构化的字段传数据，hex为截断后的数据
+func (h *hexDump) fields() []rlog.Field {
+	fields := []rlog.Field{
+		{Key: "len", Value: strconv.Itoa(len(h.data))},
+		{Key: "hex", Value: hex.EncodeToString(h.shown())},
+	}
+	if len(h.data) > len(h.shown()) {
+		fields = append(fields, rlog.Field{Key: "truncated", Value: "true"})
+	}
+	return fields
+}
+
+// HexDump 以偏移/十六进制/ASCII表格打印二进制数据，超过SetHexDumpMax设置的字节数时截断
+func HexDump(level Level, title string, data []byte) {
+	l := load()
+	if level < l.minLevel {
+		return
+	}
+
+	write(l, "", level, 0, &message{hex: &hexDump{title: title, data: data, max: l.hexDumpMax}})
+}
+
+// HexDump 以偏移/十六进制/ASCII表格打印二进制数据
+func (lg *Logger) HexDump(level Level, title string, data []byte) {
+	l := load()
+	if level < l.minLevel {
+		return
+	}
+
+	write(l, lg.module, level, 0, &message{hex: &hexDump{title: title, data: data, max: l.hexDumpMax}})
+}
+
+// SetHexDumpMax 设置HexDump最多打印的字节数，小于等于0时不限制
+func SetHexDumpMax(max int) {
+	update(func(l *logger) {
+		l.hexDumpMax = max
+	})
+}
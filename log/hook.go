@@ -0,0 +1,126 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Entry 一条日志记录，传给钩子
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Module  string
+	File    string
+	Line    int
+	Func    string
+	Message string // 日志内容，不含时间、级别等前缀
+}
+
+// Hook 日志钩子，满足所有条件的日志会在单独的goroutine里调用Fn
+// Fn panic或者处理太慢都不会影响写日志，队列满时直接丢弃
+type Hook struct {
+	Level     Level          // 最低级别，为OFF时为INFO
+	Module    string         // 只处理该模块的日志，为空时不限制
+	Pattern   *regexp.Regexp // 日志内容要匹配的正则，为空时不限制
+	QueueSize int            // 队列长度，默认1024
+	Fn        func(e *Entry)
+}
+
+type hookRunner struct {
+	hook  Hook
+	queue chan *Entry
+	done  chan struct{}
+}
+
+func (h *hookRunner) match(module string, level Level) bool {
+	if level < h.hook.Level {
+		return false
+	}
+	return h.hook.Module == "" || h.hook.Module == module
+}
+
+// post 非阻塞地把日志放到队列里，放进去时返回true
+func (h *hookRunner) post(e *Entry) bool {
+	if h.hook.Pattern != nil && !h.hook.Pattern.MatchString(e.Message) {
+		return false
+	}
+
+	select {
+	case h.queue <- e:
+		return true
+	default:
+		atomic.AddInt64(&metrics.hookDrops, 1)
+		return false
+	}
+}
+
+func (h *hookRunner) loop() {
+	for {
+		select {
+		case e := <-h.queue:
+			h.call(e)
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *hookRunner) call(e *Entry) {
+	defer func() {
+		if err := recover(); err != nil {
+			atomic.AddInt64(&metrics.hookPanics, 1)
+			fmt.Fprintf(os.Stderr, "Log hook panic: %v\n", err)
+		}
+	}()
+	h.hook.Fn(e)
+}
+
+// AddHook 注册日志钩子，返回的函数用于取消注册
+func AddHook(hook *Hook) (remove func()) {
+	if hook == nil || hook.Fn == nil {
+		return func() {}
+	}
+
+	size := hook.QueueSize
+	if size <= 0 {
+		size = 1024
+	}
+	h := &hookRunner{
+		hook:  *hook,
+		queue: make(chan *Entry, size),
+		done:  make(chan struct{}),
+	}
+	// 不设置级别时不能让所有VERBOSE日志都去格式化
+	if h.hook.Level == OFF {
+		h.hook.Level = INFO
+	}
+	go h.loop()
+
+	update(func(l *logger) {
+		l.hooks = append(append([]*hookRunner(nil), l.hooks...), h)
+	})
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			h.remove()
+		})
+	}
+}
+
+func (h *hookRunner) remove() {
+	update(func(l *logger) {
+		hooks := make([]*hookRunner, 0, len(l.hooks))
+		for _, r := range l.hooks {
+			if r != h {
+				hooks = append(hooks, r)
+			}
+		}
+		l.hooks = hooks
+	})
+	close(h.done)
+}
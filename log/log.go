@@ -1,6 +1,7 @@
 package log
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path"
@@ -8,6 +9,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -52,6 +54,11 @@ func newLevel(v interface{}) Level {
 		case "VERBOSE":
 			return VERBOSE
 		}
+
+		// V3这种写法表示DEBUG级别，同时设置详细程度，V(n)的日志在n不超过3时才不看级别，见V
+		if _, ok := levelVerbosity(s); ok {
+			return DEBUG
+		}
 	}
 
 	return INFO
@@ -92,61 +99,183 @@ func (l Level) log(cmp Level) bool {
 	}
 }
 
-type fileLogger struct {
-	on         bool
-	name       string //日志文件名
-	level      Level
-	maxSize    int64
-	maxFileNum int
-	count      int
+type remoteLogger struct {
+	on        bool
+	level     Level
+	verbosity int // 级别写成"V3"时为3，否则为-1
+	retry     int
+	rules     rules
 }
 
-type remoteLogger struct {
-	on          bool
-	level       Level
-	retry       int
-	initialized bool
-	initLock    *sync.Mutex
-	ready       bool
+// accept 级别满足或者有keep规则可能保留时返回true，规则在格式化之后再判断
+func (r *remoteLogger) accept(level Level) bool {
+	return r.on && (r.level.log(level) || r.level != OFF && r.rules.mayKeep(level))
 }
 
+// 远程日志的初始化状态，只初始化一次，不随配置更新
+var (
+	remoteInitLock    sync.Mutex
+	remoteInitialized bool
+	remoteReady       int32
+)
+
 type stdLogger struct {
-	on    bool
-	level Level
+	on        bool
+	level     Level
+	verbosity int // 级别写成"V3"时为3，否则为-1
+	rules     rules
+}
+
+// accept 级别满足或者有keep规则可能保留时返回true，规则在格式化之后再判断
+func (s *stdLogger) accept(level Level) bool {
+	return s.on && (s.level.log(level) || s.level != OFF && s.rules.mayKeep(level))
 }
 
 type logger struct {
 	module string
 
 	std    stdLogger
-	file   fileLogger
+	files  []*fileLogger // 第一个为SetFileLog设置的默认文件
 	remote remoteLogger
+	hooks  []*hookRunner
+
+	onError func(e *SinkError) // 文件日志出错和恢复时的回调
+
+	timeFormat timeFormat
+	clock      Clock
+	hexDumpMax int // HexDump最多打印的字节数
+
+	verbosity int            // V(n)的全局详细程度
+	vmodule   map[string]int // 各模块单独设置的详细程度
+
+	minLevel Level // 所有输出里最低的级别，低于它的日志直接返回
+}
+
+// lowest 计算所有打开的输出里最低的级别，没有打开的输出时返回FATAL+1
+func (l *logger) lowest() Level {
+	min := FATAL + 1
+	check := func(on bool, level Level) {
+		if on && level != OFF && level < min {
+			min = level
+		}
+	}
+
+	check(l.std.on, l.std.level)
+	check(l.std.on && l.std.level != OFF, l.std.rules.lowest())
+	for _, f := range l.files {
+		check(f.on, f.level)
+		check(f.on && f.level != OFF, f.rules.lowest())
+	}
+	check(l.remote.on, l.remote.level)
+	check(l.remote.on && l.remote.level != OFF, l.remote.rules.lowest())
+	for _, h := range l.hooks {
+		check(true, h.hook.Level)
+	}
+
+	return min
 }
 
-var dl = logger{
-	module: filepath.Base(os.Args[0]),
+// accept 判断是否有输出要写入指定模块和级别的日志
+func (l *logger) accept(module string, level Level) bool {
+	if level < l.minLevel {
+		return false
+	}
 
-	std: stdLogger{
-		level: INFO,
-	},
-	file: fileLogger{
-		name:       "",
-		level:      INFO,
-		maxSize:    128 * 1024 * 1024,
-		maxFileNum: 10,
-	},
-	remote: remoteLogger{
-		level:    INFO,
-		retry:    1,
-		initLock: &sync.Mutex{},
-	},
+	if l.std.accept(level) {
+		return true
+	}
+	for _, f := range l.files {
+		if f.accept(module, level) {
+			return true
+		}
+	}
+	if l.remote.accept(level) {
+		return true
+	}
+	for _, h := range l.hooks {
+		if h.match(module, level) {
+			return true
+		}
+	}
+	return false
 }
 
+// dl 保存当前配置的只读快照，output随时从任意goroutine读取
+// 修改配置时在dlLock保护下复制一份，修改后整体替换
+var (
+	dl     atomic.Value // *logger
+	dlLock sync.Mutex
+)
+
+func init() {
+	l := &logger{
+		module: filepath.Base(os.Args[0]),
+
+		std: stdLogger{
+			level:     INFO,
+			verbosity: -1,
+		},
+		files: []*fileLogger{
+			{
+				name:       "",
+				level:      INFO,
+				verbosity:  -1,
+				buffered:   true,
+				maxSize:    128 * 1024 * 1024,
+				maxFileNum: 10,
+				fileMode:   0666,
+				dirMode:    0755,
+				uid:        -1,
+				gid:        -1,
+				state:      &fileState{},
+			},
+		},
+		remote: remoteLogger{
+			level:     INFO,
+			verbosity: -1,
+			retry:     1,
+		},
+		hexDumpMax: defaultHexDumpMax,
+		timeFormat: defaultTimeFormat,
+		clock:      systemClock{},
+	}
+	l.minLevel = l.lowest()
+	dl.Store(l)
+}
+
+// load 取当前配置快照，不能修改
+func load() *logger {
+	return dl.Load().(*logger)
+}
+
+// update 复制当前配置，由fn修改后替换
+// fn里要修改文件日志时，需要先clone
+func update(fn func(l *logger)) {
+	dlLock.Lock()
+	defer dlLock.Unlock()
+
+	l := *load()
+	l.files = append([]*fileLogger(nil), l.files...)
+	fn(&l)
+	l.minLevel = l.lowest()
+	dl.Store(&l)
+}
+
+// agent重启的等待时间，每次启动时就退出翻倍，最多agentMaxBackoff
+var (
+	agentBackoff    = time.Second
+	agentMaxBackoff = time.Minute
+)
+
+// agent启动后这段时间内退出算启动失败，连续两次启动失败时不再重启并关闭远端log
+const agentStartup = 5 * time.Second
+
 // fork一个子进程来启动agent
-// 同时要监听子进程是否退出，一退出的话，就重新fork
-func forkExec(addr string) {
+// 同时要监听子进程是否退出，一退出的话，等一会再重新fork
+func forkExec(addr string, opts *rlog.Options) {
+	env := append(os.Environ(), "LOG_AGENT_KAFKA="+addr)
 	pa := &syscall.ProcAttr{
-		Env: append(os.Environ(), "LOG_AGENT_KAFKA="+addr),
+		Env: append(append(env, opts.Environ()...), load().timeFormat.lineFormat().Environ()...),
 	}
 	agentPath := os.Getenv("LOG_AGENT_PATH")
 	if agentPath == "" {
@@ -170,54 +299,91 @@ func forkExec(addr string) {
 		return
 	}
 
+	backoff, failures := agentBackoff, 0
 	for {
 		pid, err := syscall.ForkExec(agentPath, nil, pa)
 		if err != nil {
 			fmt.Printf("Log agent forkExec error, agent: %s, err: %v\n", agentPath, err)
 			time.Sleep(10 * time.Second)
+			continue
 		}
 
 		fmt.Printf("Log agent forkExec success, agent: %s, pid: %d\n", agentPath, pid)
+		start := time.Now()
 
 		var wstatus syscall.WaitStatus
 		rusage := &syscall.Rusage{}
-		_, err = syscall.Wait4(pid, &wstatus, syscall.WUNTRACED, rusage)
-		if err != nil {
-			fmt.Printf("Wait4 error, err: %s, disable remote log\n", err)
-			return
+		for {
+			_, err = syscall.Wait4(pid, &wstatus, syscall.WUNTRACED, rusage)
+			if err != nil {
+				fmt.Printf("Wait4 error, err: %s, disable remote log\n", err)
+				atomic.StoreInt32(&remoteReady, 0)
+				return
+			}
+			if wstatus.CoreDump() || wstatus.Exited() || wstatus.Signaled() {
+				break
+			}
+			fmt.Println("Remote log stopped.")
 		}
 
-		if wstatus.CoreDump() || wstatus.Exited() || wstatus.Signaled() {
-			continue
+		// 启动时就退出一般是队列打不开，重启也没用
+		if time.Since(start) < agentStartup {
+			if failures++; failures >= 2 {
+				fmt.Printf("Log agent %s exited during startup again, status: %#x, disable remote log\n", agentPath, wstatus)
+				atomic.StoreInt32(&remoteReady, 0)
+				return
+			}
 		} else {
-			fmt.Println("Remote log stopped.")
+			backoff, failures = agentBackoff, 0
+		}
+
+		fmt.Printf("Log agent %s exited, status: %#x, restart after %v\n", agentPath, wstatus, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > agentMaxBackoff {
+			backoff = agentMaxBackoff
 		}
 	}
 }
 
 // InitRemoteLog 初始化远端log
-func initRemoteLog(addr string) error {
-	dl.remote.initLock.Lock()
-	defer dl.remote.initLock.Unlock()
-	if dl.remote.initialized {
+func initRemoteLog(cfg *RemoteLogConfig) error {
+	remoteInitLock.Lock()
+	defer remoteInitLock.Unlock()
+	if remoteInitialized {
 		return nil
 	}
-	dl.remote.initialized = true
 
-	go forkExec(addr)
-
-	err := rlog.Init()
+	opts := &rlog.Options{
+		Key:            cfg.ShmKey,
+		Path:           cfg.ShmPath,
+		Capacity:       cfg.Capacity,
+		MaxMessage:     cfg.MaxMessage,
+		Overflow:       cfg.Overflow,
+		BlockTimeout:   cfg.BlockTimeout,
+		SpillPath:      cfg.SpillPath,
+		SpillFormat:    load().timeFormat.lineFormat(),
+		QuarantinePath: cfg.QuarantinePath,
+	}
+	for _, lane := range cfg.Lanes {
+		opts.Lanes = append(opts.Lanes, rlog.Lane{MinLevel: int(newLevel(lane.Level)), Capacity: lane.Capacity})
+	}
+	// 本进程打不开队列时agent也打不开，不启动agent
+	err := rlog.Init(opts)
 	if err != nil {
-		fmt.Printf("Remote logger initial failed: %v", err)
+		fmt.Printf("Remote logger initial failed: %v\n", err)
 		return err
 	}
-	dl.remote.ready = true
+	// 失败时下次设置远程日志还会重试
+	remoteInitialized = true
+	atomic.StoreInt32(&remoteReady, 1)
+	go forkExec(cfg.Addr, opts)
 
 	return nil
 }
 
 type StdLogConfig struct {
 	Level interface{}
+	Rules []*RuleConfig // 过滤规则，见RuleConfig
 }
 
 type FileLogConfig struct {
@@ -225,83 +391,272 @@ type FileLogConfig struct {
 	MaxSize    int
 	MaxFileNum int
 	Level      interface{}
+	MaxLevel   interface{} // 最高级别，为空时不限制
+	Modules    []string    // 只写这些模块的日志，为空时写所有模块
+
+	// 刷盘策略：never(默认)不主动刷盘，level为SyncLevel及以上的日志写完就刷盘，interval为每隔SyncInterval刷盘
+	Sync         string
+	SyncLevel    interface{}
+	SyncInterval time.Duration
+
+	// 写文件失败时的去处：stderr写到标准错误，ring先存在内存里最多RingSize行，恢复后补写到文件，为空时丢弃
+	Fallback string
+	RingSize int
+
+	Header bool // 新文件开头写一条进程信息和日志配置，正常滚动时在文件末尾写一条结束记录
+
+	// Buffer输出缓存的日志时不看该文件的最低级别，最高级别和模块仍然过滤，File总是如此
+	Buffered bool
+
+	Rules []*RuleConfig // 过滤规则，见RuleConfig
+
+	CreateDir bool        // 目录不存在时创建
+	FileMode  os.FileMode // 新建文件的权限，默认0666并受umask影响，设置了时不受umask影响
+	DirMode   os.FileMode // 新建目录的权限，默认0755并受umask影响，设置了时不受umask影响
+	Owner     string      // 新建文件和目录的用户，用户名或uid，为空时不修改
+	Group     string      // 新建文件和目录的组，组名或gid，为空时不修改
 }
 
 type RemoteLogConfig struct {
 	Addr  string
 	Level interface{}
+	Rules []*RuleConfig // 过滤规则，见RuleConfig，由Init或SetRemoteRules设置
+
+	// 和agent之间的共享内存队列，同一台机器上不相关的程序要用不同的ShmKey或ShmPath，见rlog.Options
+	ShmKey     int
+	ShmPath    string
+	Capacity   int
+	MaxMessage int
+	Lanes      []*LaneConfig // 按级别分的通道，agent先读高级别的通道，为空时只有一个Capacity大小的通道
+
+	// 队列满时的处理，drop(默认)、overwrite、block或spill，见rlog.Options
+	Overflow     string
+	BlockTimeout time.Duration
+	SpillPath    string
+
+	QuarantinePath string // agent跳过损坏的记录时把原始内容追加到这个文件
+}
+
+// LaneConfig 共享内存队列的一个通道，级别不低于Level的日志写到Level最高的那个通道
+type LaneConfig struct {
+	Level    interface{}
+	Capacity int
 }
 
 type Config struct {
-	Module string
+	Module     string
+	TimeFormat string // 时间格式，rfc3339、rfc3339nano、epochmillis等或者time.Format的格式，默认为2006-01-02 15:04:05.000000
+	TimeZone   string // 时区，local(默认)、utc或者时区名如Asia/Shanghai
+	HexDumpMax int    // HexDump最多打印的字节数，为0时用默认值4096，小于0时不限制
+
+	// V(n)的详细程度，为空时取各输出级别里V3这种写法的最大值
+	Verbosity interface{}
+	VModule   map[string]interface{} // 各模块单独设置的详细程度
 
 	Std    *StdLogConfig
 	File   *FileLogConfig
+	Files  []*FileLogConfig // 额外的文件日志，各自有级别范围、模块过滤和滚动设置，再次Init时整体替换
 	Remote *RemoteLogConfig
 }
 
-func Init(cfg *Config) {
+// Init 按配置初始化日志，文件日志的路径不可用、远程日志的队列打不开或者过滤规则有错时返回错误，其他配置仍然生效
+func Init(cfg *Config) error {
 	if cfg == nil {
 		fmt.Println("Log config is empty, disable any logger.")
-		return
+		return nil
 	}
 
+	var err error
+
 	SetModule(cfg.Module)
+	SetTimeFormat(cfg.TimeFormat)
+	if err := SetTimeZone(cfg.TimeZone); err != nil {
+		fmt.Printf("Log time zone %s error: %v, use local time.\n", cfg.TimeZone, err)
+		SetTimeZone("")
+	}
+	if cfg.HexDumpMax != 0 {
+		SetHexDumpMax(cfg.HexDumpMax)
+	}
+	SetVerbosity(configVerbosity(cfg))
+	for module, v := range cfg.VModule {
+		SetModuleVerbosity(module, v)
+	}
 
 	if cfg.Std != nil {
 		SetStdLog(cfg.Std.Level)
+		err = SetStdRules(cfg.Std.Rules)
 		fmt.Printf("Enable stdout log level %v.\n", cfg.Std.Level)
 	}
 
-	if cfg.File != nil {
-		SetFileLog(cfg.File.Path, cfg.File.Level)
-		SetMaxLogFileNum(cfg.File.MaxFileNum)
-		SetMaxLogFileSize(cfg.File.MaxSize)
+	if cfg.File != nil && cfg.File.Path != "" {
+		f, ferr := newFileLogger(cfg.File)
+		if ferr == nil {
+			ferr = f.validate()
+		}
+		if err == nil {
+			err = ferr
+		}
+		f.buffered = true
+		update(func(l *logger) {
+			f.state = l.files[0].state
+			l.files[0] = f
+		})
 		fmt.Printf("Enable file log level %v at path %s.\n", cfg.File.Level, cfg.File.Path)
 	}
 
+	if ferr := setFileLogs(cfg.Files); err == nil {
+		err = ferr
+	}
+
 	if cfg.Remote != nil {
-		SetRemoteLog(cfg.Remote)
+		if rerr := SetRemoteLog(cfg.Remote); err == nil {
+			err = rerr
+		}
+		if rerr := SetRemoteRules(cfg.Remote.Rules); err == nil {
+			err = rerr
+		}
 		fmt.Printf("Enable remove log level %v\n", cfg.Remote.Level)
 	}
+
+	return err
 }
 
 // SetStdLog 文件日志的名字
 func SetStdLog(level interface{}) {
-	dl.std.on = true
-	dl.std.level = newLevel(level)
+	update(func(l *logger) {
+		l.std.on = true
+		l.std.level = newLevel(level)
+		l.std.verbosity = sinkVerbosity(level)
+	})
 }
 
 func DisableStdLog(on bool) {
-	dl.std.on = true
+	update(func(l *logger) {
+		l.std.on = false
+	})
 }
 
 // 设置模块名，默认为程序名
 func SetModule(module string) {
 	if module == "" {
-		dl.module = filepath.Base(os.Args[0])
-	} else {
-		dl.module = module
+		module = filepath.Base(os.Args[0])
 	}
+
+	update(func(l *logger) {
+		l.module = module
+	})
 }
 
 // SetLogFileName 文件日志的名字
 func SetFileLog(name string, level interface{}) {
-	if dl.file.name == "" {
+	if name == "" {
 		return
 	}
 
-	dl.file.on = true
-	dl.file.name = name
-	dl.file.level = newLevel(level)
+	update(func(l *logger) {
+		f := l.files[0].clone()
+		f.on = true
+		f.name = name
+		f.level = newLevel(level)
+		f.verbosity = sinkVerbosity(level)
+		l.files[0] = f
+	})
+}
+
+// setFileLogs 用cfgs替换额外的文件日志，路径相同的沿用打开的文件，去掉的关闭
+// 再次Init时不会重复添加
+func setFileLogs(cfgs []*FileLogConfig) error {
+	var err error
+	files := make([]*fileLogger, 0, len(cfgs))
+	for _, fc := range cfgs {
+		if fc == nil || fc.Path == "" {
+			continue
+		}
+		f, ferr := newFileLogger(fc)
+		if ferr == nil {
+			ferr = f.validate()
+		}
+		if err == nil {
+			err = ferr
+		}
+		files = append(files, f)
+		fmt.Printf("Enable file log level %v-%v modules %v at path %s.\n",
+			fc.Level, fc.MaxLevel, fc.Modules, fc.Path)
+	}
+
+	var removed []*fileState
+	update(func(l *logger) {
+		old := l.files[1:]
+		for _, f := range files {
+			for _, o := range old {
+				if o.name == f.name {
+					f.state = o.state
+					break
+				}
+			}
+		}
+		for _, o := range old {
+			kept := false
+			for _, f := range files {
+				kept = kept || f.state == o.state
+			}
+			if !kept {
+				removed = append(removed, o.state)
+			}
+		}
+		l.files = append(l.files[:1], files...)
+	})
+
+	for _, st := range removed {
+		st.mu.Lock()
+		st.close()
+		st.mu.Unlock()
+	}
+	return err
+}
+
+// AddFileLog 增加一个文件日志，可以按级别范围和模块过滤，滚动设置独立于其他文件
+// 路径不可用时返回错误，文件日志仍然加上，写失败时按Fallback处理
+func AddFileLog(cfg *FileLogConfig) error {
+	if cfg == nil || cfg.Path == "" {
+		return nil
+	}
+
+	f, err := newFileLogger(cfg)
+	if err == nil {
+		err = f.validate()
+	}
+	update(func(l *logger) {
+		l.files = append(l.files, f)
+	})
+	return err
 }
 
 func DisableRemoteLog() {
-	dl.remote.on = false
+	update(func(l *logger) {
+		l.remote.on = false
+	})
 }
 
 // SetLogMaxSize 设置log文件的大小
 func SetMaxLogFileSize(logSize int) {
+	update(func(l *logger) {
+		f := l.files[0].clone()
+		f.maxSize = fileSize(logSize)
+		l.files[0] = f
+	})
+}
+
+// SetLogMaxFileNum 设置log文件数
+func SetMaxLogFileNum(maxFileNum int) {
+	update(func(l *logger) {
+		f := l.files[0].clone()
+		f.maxFileNum = fileNum(maxFileNum)
+		l.files[0] = f
+	})
+}
+
+func fileSize(logSize int) int64 {
 	if logSize == 0 {
 		logSize = 128 * 1024 * 1024
 	}
@@ -310,11 +665,10 @@ func SetMaxLogFileSize(logSize int) {
 		logSize = 1024 * 1024
 	}
 
-	dl.file.maxSize = int64(logSize)
+	return int64(logSize)
 }
 
-// SetLogMaxFileNum 设置log文件数
-func SetMaxLogFileNum(maxFileNum int) {
+func fileNum(maxFileNum int) int {
 	if maxFileNum == 0 {
 		maxFileNum = 10
 	}
@@ -327,73 +681,224 @@ func SetMaxLogFileNum(maxFileNum int) {
 		maxFileNum = 1
 	}
 
-	dl.file.maxFileNum = maxFileNum
+	return maxFileNum
 }
 
 // 开启远程日志
-func SetRemoteLog(cfg *RemoteLogConfig) {
-	dl.remote.on = true
-	dl.remote.level = newLevel(cfg.Level)
-	initRemoteLog(cfg.Addr)
+// 队列打不开或者队列设置有错时返回错误，远程日志不会输出
+func SetRemoteLog(cfg *RemoteLogConfig) error {
+	update(func(l *logger) {
+		l.remote.on = true
+		l.remote.level = newLevel(cfg.Level)
+		l.remote.verbosity = sinkVerbosity(cfg.Level)
+	})
+	return initRemoteLog(cfg)
 }
 
 func DisableFileLog() {
-	dl.file.on = false
+	update(func(l *logger) {
+		f := l.files[0].clone()
+		f.on = false
+		l.files[0] = f
+	})
 }
 
 // SetRemoteRetryCount 写远程日志失败的情况下，再重试的次数，默认是1
 func SetRemoteRetryCount(retries int) {
-	dl.remote.retry = retries
+	update(func(l *logger) {
+		l.remote.retry = retries
+	})
 }
 
 // Fatal 大于等于FATAL时都打印
 func Fatal(format string, v ...interface{}) {
-	output(FATAL, format, v...)
+	output("", FATAL, format, v...)
 }
 
 // Critial 大于等于CRITICAL时都打印
 func Critical(format string, v ...interface{}) {
-	output(CRITICAL, format, v...)
+	output("", CRITICAL, format, v...)
 }
 
 // Error 大于等于ERROR时都打印
 func Error(format string, v ...interface{}) {
-	output(ERROR, format, v...)
+	output("", ERROR, format, v...)
 }
 
 // Warn 大于等于WARN时都打印
 func Warn(format string, v ...interface{}) {
-	output(WARN, format, v...)
+	output("", WARN, format, v...)
 }
 
 // Info 大于等于INFO时都打印
 func Info(format string, v ...interface{}) {
-	output(INFO, format, v...)
+	output("", INFO, format, v...)
 }
 
 // Debug 大于等于DEBUG时都打印
 func Debug(format string, v ...interface{}) {
-	output(DEBUG, format, v...)
+	output("", DEBUG, format, v...)
 }
 
 // Verbose 大于等于VERBOSE时都打印
 func Verbose(format string, v ...interface{}) {
-	output(VERBOSE, format, v...)
+	output("", VERBOSE, format, v...)
+}
+
+// Logger 指定模块名的日志，用于一个进程里有多个模块的情况
+type Logger struct {
+	module string
+}
+
+// New 创建模块日志，module为空时使用默认模块名
+func New(module string) *Logger {
+	return &Logger{module: module}
+}
+
+// Fatal 大于等于FATAL时都打印
+func (l *Logger) Fatal(format string, v ...interface{}) {
+	output(l.module, FATAL, format, v...)
+}
+
+// Critical 大于等于CRITICAL时都打印
+func (l *Logger) Critical(format string, v ...interface{}) {
+	output(l.module, CRITICAL, format, v...)
+}
+
+// Error 大于等于ERROR时都打印
+func (l *Logger) Error(format string, v ...interface{}) {
+	output(l.module, ERROR, format, v...)
+}
+
+// Warn 大于等于WARN时都打印
+func (l *Logger) Warn(format string, v ...interface{}) {
+	output(l.module, WARN, format, v...)
+}
+
+// Info 大于等于INFO时都打印
+func (l *Logger) Info(format string, v ...interface{}) {
+	output(l.module, INFO, format, v...)
+}
+
+// Debug 大于等于DEBUG时都打印
+func (l *Logger) Debug(format string, v ...interface{}) {
+	output(l.module, DEBUG, format, v...)
+}
+
+// Verbose 大于等于VERBOSE时都打印
+func (l *Logger) Verbose(format string, v ...interface{}) {
+	output(l.module, VERBOSE, format, v...)
+}
+
+// InfoFn 同Info，只有要输出时才调用fn生成日志内容
+func (l *Logger) InfoFn(fn func() string) {
+	outputFn(l.module, INFO, fn)
+}
+
+// DebugFn 同Debug，只有要输出时才调用fn生成日志内容
+func (l *Logger) DebugFn(fn func() string) {
+	outputFn(l.module, DEBUG, fn)
+}
+
+// VerboseFn 同Verbose，只有要输出时才调用fn生成日志内容
+func (l *Logger) VerboseFn(fn func() string) {
+	outputFn(l.module, VERBOSE, fn)
+}
+
+// Enabled 判断该模块指定级别的日志是否会输出
+func (l *Logger) Enabled(level Level) bool {
+	lg := load()
+	module := l.module
+	if module == "" {
+		module = lg.module
+	}
+	return lg.accept(module, level)
+}
+
+// Enabled 判断指定级别的日志是否会输出到任意一个输出
+// 参数需要计算或者装箱的日志，可以先判断再打印，避免不输出时也有内存分配
+func Enabled(level Level) bool {
+	return level >= load().minLevel
+}
+
+// InfoFn 同Info，只有要输出时才调用fn生成日志内容
+func InfoFn(fn func() string) {
+	outputFn("", INFO, fn)
+}
+
+// DebugFn 同Debug，只有要输出时才调用fn生成日志内容
+func DebugFn(fn func() string) {
+	outputFn("", DEBUG, fn)
+}
+
+// VerboseFn 同Verbose，只有要输出时才调用fn生成日志内容
+func VerboseFn(fn func() string) {
+	outputFn("", VERBOSE, fn)
+}
+
+// output 输出日志，module为空时使用默认模块名
+func output(module string, level Level, format string, v ...interface{}) {
+	l := load()
+	if level < l.minLevel {
+		return
+	}
+
+	write(l, module, level, 1, &message{format: format, args: v})
+}
+
+// outputFn 同output，日志内容由fn生成
+func outputFn(module string, level Level, fn func() string) {
+	l := load()
+	if level < l.minLevel {
+		return
+	}
+
+	write(l, module, level, 1, &message{fn: fn})
+}
+
+// 格式化日志用的缓存
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
 }
 
-func output(level Level, format string, v ...interface{}) {
-	writeStd := dl.std.on && dl.std.level.log(level)
-	writeFile := dl.file.on && dl.file.level.log(level)
-	writeRemote := dl.remote.on && dl.remote.level.log(level)
+func getBuffer() *bytes.Buffer {
+	return bufPool.Get().(*bytes.Buffer)
+}
 
-	if !writeStd && !writeFile && !writeRemote {
+func putBuffer(buf *bytes.Buffer) {
+	// 太大的不放回去，避免一直占着内存
+	if buf.Cap() > 64*1024 {
 		return
 	}
+	buf.Reset()
+	bufPool.Put(buf)
+}
+
+// write 取调用位置后格式化并写到各个输出
+// skip为调用write的函数之上还要跳过的调用层数
+func write(l *logger, module string, level Level, skip int, m *message) {
+	if module == "" {
+		module = l.module
+	}
+
+	if !l.accept(module, level) && !l.acceptV(module, level, m) {
+		return
+	}
+
+	e := Entry{
+		Time:   l.clock.Now(),
+		Level:  level,
+		Module: module,
+	}
+	e.File, e.Line, e.Func = caller(skip + 2)
+	emit(l, &e, m, false)
+}
 
-	var funcName, file string
-	var pc uintptr
-	var ok bool
-	pc, file, line, ok := runtime.Caller(2)
+// caller 取调用位置，skip为0时是调用caller的函数
+func caller(skip int) (file string, line int, funcName string) {
+	pc, file, line, ok := runtime.Caller(skip + 1)
 	if !ok {
 		file = "???"
 		line = 0
@@ -414,98 +919,129 @@ func output(level Level, format string, v ...interface{}) {
 		}
 	}
 
-	timeStr := time.Now().String()[0:26]
-	str := fmt.Sprintf(format, v...)
-	str = fmt.Sprintf(
-		"%s|%s|%s|%s:%d %s|%s\n",
-		timeStr,
-		level.name(),
-		dl.module,
-		file,
-		line,
-		funcName,
-		str)
+	return file, line, funcName
+}
 
-	if writeStd {
-		outputToStd(str)
-	}
+// emit 把已经取好时间和调用位置的日志格式化并写到各个输出
+// flushed为Buffer输出的缓存日志，已经按缓存的级别判断过，主文件日志和设置了Buffered的文件日志不再看最低级别
+// 级别写成"V3"的输出对V(n)的日志也不看级别，见passV
+func emit(l *logger, e *Entry, m *message, flushed bool) {
+	module, level := e.Module, e.Level
 
-	if writeFile {
-		outputToFile(str)
+	// pass 输出的级别判断
+	pass := func(on bool, sinkLevel Level, verbosity int, buffered bool) bool {
+		return on && (sinkLevel.log(level) || sinkLevel != OFF && (flushed && buffered || l.passV(module, verbosity, m)))
+	}
+	acceptFile := func(f *fileLogger) bool {
+		return f.accept(module, level) || pass(f.on, f.level, f.verbosity, f.buffered) && f.route(module, level)
 	}
 
-	if writeRemote {
-		outputToRemote(str)
+	writeStd := l.std.accept(level) || pass(l.std.on, l.std.level, l.std.verbosity, false)
+	writeFile := false
+	for _, f := range l.files {
+		if acceptFile(f) {
+			writeFile = true
+			break
+		}
+	}
+	writeRemote := l.remote.accept(level) || pass(l.remote.on, l.remote.level, l.remote.verbosity, false)
+	writeHook := false
+	for _, h := range l.hooks {
+		if h.match(module, level) {
+			writeHook = true
+			break
+		}
 	}
 
-	if level == FATAL {
-		panic(str)
+	if !writeStd && !writeFile && !writeRemote && !writeHook {
+		return
 	}
-}
 
-//const colTitle = "__________00_01_02_03_04_05_06_07__08_09_0A_0B_0C_0D_0E_0F\n"
+	msg := getBuffer()
+	defer putBuffer(msg)
+	m.appendTo(msg)
 
-func outputToStd(str string) {
-	fmt.Fprintf(os.Stdout, str)
-}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	l.appendEntry(buf, e, msg.Bytes())
+	b := buf.Bytes()
 
-func outputToFile(str string) {
-	if dl.file.name == "" {
-		return
+	// 各输出的规则过滤、钩子放进队列之后才计数，哪里都没写的另外计数
+	written := false
+	if writeStd && l.std.rules.filter(pass(l.std.on, l.std.level, l.std.verbosity, false), e, msg.Bytes()) {
+		outputToStd(b)
+		written = true
 	}
 
-	f, err := os.OpenFile(dl.file.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		return
+	if writeFile {
+		for _, f := range l.files {
+			if acceptFile(f) && f.rules.filter(pass(f.on, f.level, f.verbosity, f.buffered), e, msg.Bytes()) {
+				outputToFile(l, f, level, b)
+				written = true
+			}
+		}
 	}
-	fmt.Fprintf(f, str)
-	f.Close()
 
-	dl.file.count++
-	if dl.file.count > 1000 {
-		dl.file.count = 0
-		shiftFiles()
+	if writeRemote && l.remote.rules.filter(pass(l.remote.on, l.remote.level, l.remote.verbosity, false), e, msg.Bytes()) {
+		outputToRemote(e, m, msg.String(), l.remote.retry)
+		written = true
 	}
-}
 
-func outputToRemote(str string) {
-	if !dl.remote.ready {
-		return
+	if writeHook {
+		message := msg.String()
+		for _, h := range l.hooks {
+			if h.match(module, level) {
+				he := *e
+				he.Message = message
+				if h.post(&he) {
+					written = true
+				}
+			}
+		}
 	}
 
-	rlog.Write(&rlog.Message{
-		Module:     dl.module,
-		Msg:        str,
-		RetryTimes: dl.remote.retry,
-	})
+	if written {
+		countLine(level)
+	} else {
+		atomic.AddInt64(&metrics.filtered, 1)
+	}
+
+	if level == FATAL {
+		panic(string(b))
+	}
 }
 
-func shiftFiles() error {
-	fileInfo, err := os.Stat(dl.file.name)
-	if err != nil {
-		return err
+func outputToStd(b []byte) {
+	os.Stdout.Write(b)
+	countSink(sinkStd)
+}
+
+// outputToRemote 写到agent的队列，msg为日志内容，agent按记录里的时间、级别、pid等字段格式化
+// HexDump的数据以字段传，内容只有标题
+func outputToRemote(e *Entry, m *message, msg string, retry int) {
+	if atomic.LoadInt32(&remoteReady) == 0 {
+		return
 	}
 
-	if fileInfo.Size() < dl.file.maxSize {
-		return nil
+	r := &rlog.Record{
+		Time:   e.Time,
+		Level:  int(e.Level),
+		Module: e.Module,
+		File:   e.File,
+		Line:   e.Line,
+		Func:   e.Func,
+		Msg:    msg,
 	}
-	//shift file
-	for i := dl.file.maxFileNum - 2; i >= 0; i-- {
-		var nameOld string
-		if i == 0 {
-			nameOld = dl.file.name
-		} else {
-			nameOld = fmt.Sprintf("%s.%d", dl.file.name, i)
-		}
-		fileInfo, err := os.Stat(nameOld)
-		if err != nil {
-			continue
-		}
-		if fileInfo.IsDir() {
-			continue
-		}
-		nameNew := fmt.Sprintf("%s.%d", dl.file.name, i+1)
-		os.Rename(nameOld, nameNew)
+	if m.hex != nil {
+		r.Msg, r.Fields = m.hex.title, m.hex.fields()
+	}
+	err := rlog.WriteRecord(r, retry)
+	switch err {
+	case nil:
+		countSink(sinkRemote)
+	case rlog.ErrorQueryFull:
+		atomic.AddInt64(&metrics.remoteDrops, 1)
+	default:
+		atomic.AddInt64(&metrics.writeErrors, 1)
 	}
-	return nil
 }
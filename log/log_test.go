@@ -1,8 +1,24 @@
 package log
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/plexsec/utils/log/rlog"
+	"github.com/plexsec/utils/stat"
+	"github.com/stretchr/testify/assert"
 )
 
 func test() {
@@ -15,14 +31,925 @@ func test() {
 	}
 	st := &testStruct{100, 10.1, "this is struct test"}
 
-	Init("len=%d title=%s struct=%v", a, str, st)
+	Debug("len=%d title=%s struct=%v", a, str, st)
 	Info("len=%d title=%s struct=%v", a, str, st)
 }
 
 func TestAll(t *testing.T) {
-	os.Setenv("LOG_AGENT_PATH", "./agent/agent")
-	SetLog("test.log", LOGLEVEL_DEBUG)
+	Init(&Config{
+		Module: "test",
+		File: &FileLogConfig{
+			Path:  filepath.Join(t.TempDir(), "test.log"),
+			Level: "DEBUG",
+		},
+	})
 	test()
-	SetLogFileName("")
+	DisableFileLog()
 	test()
 }
+
+func readFile(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileRouting(t *testing.T) {
+	dir := t.TempDir()
+	errPath := filepath.Join(dir, "error.log")
+	parserPath := filepath.Join(dir, "parser.log")
+	warnPath := filepath.Join(dir, "warn.log")
+
+	saved := load()
+	defer dl.Store(saved)
+
+	SetModule("main")
+	Init(&Config{
+		Module: "main",
+		Files: []*FileLogConfig{
+			{Path: errPath, Level: "ERROR"},
+			{Path: parserPath, Level: "DEBUG", Modules: []string{"parser"}},
+			{Path: warnPath, Level: "INFO", MaxLevel: "WARN"},
+		},
+	})
+
+	parser := New("parser")
+	Info("main info")
+	Error("main error")
+	parser.Debug("parser debug")
+	parser.Error("parser error")
+
+	errLog := readFile(t, errPath)
+	assert.True(t, strings.Contains(errLog, "|ERROR|main|"), errLog)
+	assert.True(t, strings.Contains(errLog, "|ERROR|parser|"), errLog)
+	assert.False(t, strings.Contains(errLog, "main info"), errLog)
+
+	parserLog := readFile(t, parserPath)
+	assert.True(t, strings.Contains(parserLog, "parser debug"), parserLog)
+	assert.True(t, strings.Contains(parserLog, "parser error"), parserLog)
+	assert.False(t, strings.Contains(parserLog, "main"), parserLog)
+
+	warnLog := readFile(t, warnPath)
+	assert.True(t, strings.Contains(warnLog, "main info"), warnLog)
+	assert.False(t, strings.Contains(warnLog, "error"), warnLog)
+}
+
+// TestConcurrentReconfigure 并发写日志和修改配置，需要用go test -race跑
+func TestConcurrentReconfigure(t *testing.T) {
+	dir := t.TempDir()
+	saved := load()
+	defer dl.Store(saved)
+
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = devNull
+	defer func() {
+		os.Stdout = stdout
+		devNull.Close()
+	}()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l := New(fmt.Sprintf("m%d", i))
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				Info("goroutine %d line %d", i, j)
+				l.Debug("goroutine %d line %d", i, j)
+				l.Error("goroutine %d line %d", i, j)
+			}
+		}(i)
+	}
+
+	for i := 0; i < 200; i++ {
+		SetStdLog("DEBUG")
+		SetFileLog(filepath.Join(dir, "a.log"), "INFO")
+		SetModule(fmt.Sprintf("module%d", i))
+		SetMaxLogFileSize(i * 1024 * 1024)
+		SetMaxLogFileNum(i % 5)
+		SetRemoteRetryCount(i % 3)
+		if i%50 == 0 {
+			AddFileLog(&FileLogConfig{
+				Path:    filepath.Join(dir, fmt.Sprintf("m%d.log", i%4)),
+				Level:   "DEBUG",
+				Modules: []string{fmt.Sprintf("m%d", i%4)},
+			})
+		}
+		DisableStdLog(true)
+		DisableFileLog()
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestMetrics(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	before := GetMetrics()
+	path := filepath.Join(t.TempDir(), "metrics.log")
+	AddFileLog(&FileLogConfig{Path: path, Level: "INFO"})
+	Debug("not counted")
+	Warn("counted")
+	AddFileLog(&FileLogConfig{Path: t.TempDir(), Level: "INFO"})
+	Error("write to directory fails")
+
+	after := GetMetrics()
+	assert.Equal(t, before.Lines["DEBUG"], after.Lines["DEBUG"])
+	assert.Equal(t, before.Lines["WARN"]+1, after.Lines["WARN"])
+	assert.Equal(t, before.Lines["ERROR"]+1, after.Lines["ERROR"])
+	assert.Equal(t, before.Sinks[path]+2, after.Sinks[path])
+	assert.Equal(t, before.WriteErrors+1, after.WriteErrors)
+}
+
+func TestPublishMetrics(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	attrs := make(map[string]int64)
+	statAdd = func(attr string, v int64) { attrs[attr] += v }
+	defer func() { statAdd = stat.Add }()
+	publishMetrics()
+	for k := range attrs {
+		delete(attrs, k)
+	}
+
+	path := filepath.Join(t.TempDir(), "app.v1", "error.log")
+	AddFileLog(&FileLogConfig{Path: path, Level: "INFO", CreateDir: true})
+	Error("published")
+	publishMetrics()
+
+	// 属性名按.拆分，文件名里的.不能出现在输出名里
+	assert.Equal(t, int64(1), attrs["log.sink.file_error_log"], attrs)
+	assert.Equal(t, int64(1), attrs["log.lines.error"], attrs)
+	for attr := range attrs {
+		if strings.HasPrefix(attr, "log.sink.") {
+			assert.Equal(t, 3, len(strings.Split(attr, ".")), attr)
+		}
+	}
+}
+
+func TestLazy(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	path := filepath.Join(t.TempDir(), "lazy.log")
+	SetFileLog(path, "INFO")
+	called := false
+	DebugFn(func() string {
+		called = true
+		return "debug"
+	})
+	InfoFn(func() string { return "lazy info" })
+	New("lazy").InfoFn(func() string { return "100%" })
+
+	assert.False(t, called, "fn should not be called when level is disabled")
+	assert.False(t, Enabled(DEBUG))
+	assert.True(t, Enabled(INFO))
+	content := readFile(t, path)
+	assert.True(t, strings.Contains(content, "|INFO|lazy|"), content)
+	assert.True(t, strings.Contains(content, "|lazy info\n"), content)
+	assert.True(t, strings.Contains(content, "|100%\n"), content)
+}
+
+func benchmarkSetup(b *testing.B) func() {
+	saved := load()
+	SetFileLog(filepath.Join(b.TempDir(), "bench.log"), "INFO")
+	b.ReportAllocs()
+	b.ResetTimer()
+	return func() { dl.Store(saved) }
+}
+
+func BenchmarkDisabled(b *testing.B) {
+	defer benchmarkSetup(b)()
+	for i := 0; i < b.N; i++ {
+		Debug("disabled %s", "line")
+	}
+}
+
+func BenchmarkDisabledNoArgs(b *testing.B) {
+	defer benchmarkSetup(b)()
+	for i := 0; i < b.N; i++ {
+		Debug("disabled line")
+	}
+}
+
+func BenchmarkDisabledEnabledCheck(b *testing.B) {
+	defer benchmarkSetup(b)()
+	for i := 0; i < b.N; i++ {
+		if Enabled(DEBUG) {
+			Debug("disabled %d", i)
+		}
+	}
+}
+
+func BenchmarkDisabledFn(b *testing.B) {
+	defer benchmarkSetup(b)()
+	for i := 0; i < b.N; i++ {
+		DebugFn(func() string {
+			return fmt.Sprintf("disabled %d", i)
+		})
+	}
+}
+
+func BenchmarkModuleFiltered(b *testing.B) {
+	defer benchmarkSetup(b)()
+	DisableFileLog()
+	AddFileLog(&FileLogConfig{
+		Path:    filepath.Join(b.TempDir(), "module.log"),
+		Level:   "DEBUG",
+		Modules: []string{"other"},
+	})
+	l := New("filtered")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Debug("filtered line")
+	}
+}
+
+func BenchmarkInfo(b *testing.B) {
+	defer benchmarkSetup(b)()
+	for i := 0; i < b.N; i++ {
+		Info("enabled %d %s", i, "line")
+	}
+}
+
+func TestHook(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	entries := make(chan *Entry, 10)
+	t.Cleanup(AddHook(&Hook{
+		Level:   WARN,
+		Module:  "alert",
+		Pattern: regexp.MustCompile(`disk \d+% full`),
+		Fn: func(e *Entry) {
+			entries <- e
+		},
+	}))
+	// 每个钩子拿到的是自己的一份，改了也不影响别的钩子
+	t.Cleanup(AddHook(&Hook{
+		Fn: func(e *Entry) {
+			e.Message = "changed"
+			panic("hook panic")
+		},
+	}))
+
+	l := New("alert")
+	l.Info("disk 99% full")
+	l.Error("disk %d%% full", 95)
+	Error("disk 95% full")
+	l.Error("disk ok")
+
+	select {
+	case e := <-entries:
+		assert.Equal(t, ERROR, e.Level)
+		assert.Equal(t, "alert", e.Module)
+		assert.Equal(t, "disk 95% full", e.Message)
+		assert.Equal(t, "TestHook", e.Func)
+	case <-time.After(time.Second):
+		t.Fatal("hook not called")
+	}
+
+	select {
+	case e := <-entries:
+		t.Fatalf("unexpected entry: %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHookDefaults(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	// 不设置级别的钩子按INFO处理，VERBOSE的日志不用格式化
+	SetStdLog("OFF")
+	DisableFileLog()
+	t.Cleanup(AddHook(&Hook{
+		Pattern: regexp.MustCompile("^match"),
+		Fn:      func(e *Entry) {},
+	}))
+	assert.False(t, Enabled(VERBOSE))
+	assert.True(t, Enabled(INFO))
+
+	// 只有放进钩子队列的才算输出的行数
+	before := GetMetrics()
+	Info("match")
+	Info("other")
+	after := GetMetrics()
+	assert.Equal(t, before.Lines["INFO"]+1, after.Lines["INFO"])
+	assert.Equal(t, before.Filtered+1, after.Filtered)
+}
+
+func TestHexDump(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	path := filepath.Join(t.TempDir(), "hex.log")
+	SetFileLog(path, "INFO")
+	SetHexDumpMax(20)
+	data := []byte("ABCDEFGHIJKLMNOP\x00\x01\x02\x03tail")
+
+	HexDump(DEBUG, "disabled", data)
+	HexDump(INFO, "packet", data)
+	content := readFile(t, path)
+	assert.Equal(t, ""+
+		"|packet len=24\n"+
+		colTitle+"\n"+
+		"00000000  41 42 43 44 45 46 47 48  49 4A 4B 4C 4D 4E 4F 50  |ABCDEFGHIJKLMNOP|\n"+
+		"00000010  00 01 02 03                                       |....|\n"+
+		"... truncated 4 bytes\n",
+		content[strings.Index(content, "|packet"):])
+
+	// 远程日志以字段传数据
+	h := &hexDump{title: "packet", data: data, max: 20}
+	assert.Equal(t, []rlog.Field{
+		{Key: "len", Value: "24"},
+		{Key: "hex", Value: "4142434445464748494a4b4c4d4e4f5000010203"},
+		{Key: "truncated", Value: "true"},
+	}, h.fields())
+}
+
+func TestVerbosity(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	path := filepath.Join(t.TempDir(), "v.log")
+	Init(&Config{
+		Module:  "main",
+		File:    &FileLogConfig{Path: path, Level: "V2"},
+		VModule: map[string]interface{}{"parser": "V4"},
+	})
+	assert.Equal(t, DEBUG, newLevel("v2"))
+
+	V(2).Debug("main v2")
+	V(3).Debug("main v3")
+	parser := New("parser")
+	parser.V(4).Verbose("parser v4")
+	parser.V(5).Verbose("parser v5")
+	assert.True(t, V(1).Enabled())
+	assert.False(t, parser.V(5).Enabled())
+
+	SetModuleVerbosity("parser", nil)
+	parser.V(3).Info("parser v3")
+
+	content := readFile(t, path)
+	assert.True(t, strings.Contains(content, "|DEBUG|main|"), content)
+	assert.True(t, strings.Contains(content, "main v2"), content)
+	assert.False(t, strings.Contains(content, "main v3"), content)
+	assert.True(t, strings.Contains(content, "parser v4"), content)
+	assert.False(t, strings.Contains(content, "parser v5"), content)
+	assert.False(t, strings.Contains(content, "parser v3"), content)
+}
+
+func TestVerbositySinkLevel(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	path := filepath.Join(t.TempDir(), "v3.log")
+	Init(&Config{
+		Module: "main",
+		File:   &FileLogConfig{Path: path, Level: "V3"},
+	})
+
+	Verbose("plain verbose")
+	Debug("plain debug")
+	V(3).Verbose("v3 verbose")
+	V(4).Verbose("v4 verbose")
+
+	content := readFile(t, path)
+	assert.False(t, strings.Contains(content, "plain verbose"), content)
+	assert.True(t, strings.Contains(content, "plain debug"), content)
+	assert.True(t, strings.Contains(content, "v3 verbose"), content)
+	assert.False(t, strings.Contains(content, "v4 verbose"), content)
+}
+
+func TestSample(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	path := filepath.Join(t.TempDir(), "sample.log")
+	SetFileLog(path, "INFO")
+	l := New("sample")
+	for i := 0; i < 10; i++ {
+		EveryN(3).Info("every3 %d", i)
+		FirstN(2).Warn("first2 %d", i)
+		l.Every(time.Hour).Error("hourly %d", i)
+		l.EveryN(3).Info("module every3 %d", i)
+	}
+
+	content := readFile(t, path)
+	assert.Equal(t, 4, strings.Count(content, "|every3"), content)
+	assert.True(t, strings.Contains(content, "every3 9"), content)
+	assert.Equal(t, 2, strings.Count(content, "first2"), content)
+	assert.Equal(t, 1, strings.Count(content, "hourly"), content)
+	assert.Equal(t, 5, strings.Count(content, "|sample|log_test.go"), content)
+}
+
+func TestBuffer(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	path := filepath.Join(t.TempDir(), "buffer.log")
+	SetFileLog(path, "VERBOSE")
+
+	ok := NewBuffer(&BufferOptions{Module: "req"})
+	ctx := NewContext(context.Background(), ok)
+	FromContext(ctx).Debug("ok debug")
+	FromContext(ctx).Info("ok info")
+	FromContext(ctx).Finish(nil)
+
+	failed := NewBuffer(&BufferOptions{Module: "req", Max: 2})
+	ctx = NewContext(context.Background(), failed)
+	FromContext(ctx).Verbose("failed verbose %d", 1)
+	_, _, line, _ := runtime.Caller(0)
+	FromContext(ctx).Debug("failed debug %d", 2)
+	FromContext(ctx).Debug("failed debug %d", 3)
+	time.Sleep(time.Millisecond)
+	FromContext(ctx).Error("failed error")
+	FromContext(ctx).Finish(errors.New("failed"))
+
+	FromContext(context.Background()).Debug("no buffer")
+
+	content := readFile(t, path)
+	assert.False(t, strings.Contains(content, "ok debug"), content)
+	assert.True(t, strings.Contains(content, "ok info"), content)
+	assert.False(t, strings.Contains(content, "failed verbose"), content)
+	assert.True(t, strings.Contains(content, "1 earlier buffered lines dropped"), content)
+	assert.True(t, strings.Contains(content, fmt.Sprintf("|DEBUG|req|log_test.go:%d TestBuffer|failed debug 2", line+1)), content)
+	assert.True(t, strings.Contains(content, "no buffer"), content)
+
+	lines := strings.Split(strings.TrimSpace(content), "\n")
+	errIndex, debugIndex := -1, -1
+	for i, l := range lines {
+		if strings.Contains(l, "failed error") {
+			errIndex = i
+		}
+		if strings.Contains(l, "failed debug 3") {
+			debugIndex = i
+		}
+	}
+	assert.True(t, errIndex < debugIndex, "buffered lines are flushed after the error")
+	assert.True(t, lines[debugIndex][:26] < lines[errIndex][:26], "buffered lines keep their original time")
+}
+
+func TestBufferInfoSink(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	// 输出的级别为INFO时，缓存的DEBUG日志在出错后也要输出
+	path := filepath.Join(t.TempDir(), "buffer.log")
+	SetFileLog(path, "INFO")
+	SetStdLog("OFF")
+
+	b := NewBuffer(&BufferOptions{Module: "req"})
+	b.Verbose("buffered verbose")
+	b.Debug("buffered debug")
+	b.Error("trigger")
+	FromContext(context.Background()).Debug("no buffer")
+	assert.False(t, strings.Contains(readFile(t, path), "buffered debug"))
+	b.Finish(errors.New("failed"))
+
+	content := readFile(t, path)
+	assert.True(t, strings.Contains(content, "|DEBUG|req|"), content)
+	assert.True(t, strings.Contains(content, "buffered debug"), content)
+	assert.True(t, strings.Contains(content, "buffered verbose"), content)
+	assert.True(t, strings.Index(content, "trigger") < strings.Index(content, "buffered debug"), content)
+	assert.False(t, strings.Contains(content, "no buffer"), content)
+}
+
+func TestReInit(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	dir := t.TempDir()
+	errPath := filepath.Join(dir, "error.log")
+	cfg := &Config{
+		File:  &FileLogConfig{Path: filepath.Join(dir, "app.log"), Level: "INFO"},
+		Files: []*FileLogConfig{{Path: errPath, Level: "ERROR"}},
+	}
+	assert.Nil(t, Init(cfg))
+	Error("first")
+	st := load().files[1].state
+
+	// 再次Init替换额外的文件日志，不重复添加，路径相同的沿用原来的文件
+	assert.Nil(t, Init(cfg))
+	assert.Equal(t, 2, len(load().files))
+	assert.True(t, st == load().files[1].state)
+	Error("second")
+	assert.Equal(t, 1, strings.Count(readFile(t, errPath), "second"))
+
+	cfg.Files = nil
+	assert.Nil(t, Init(cfg))
+	assert.Equal(t, 1, len(load().files))
+	assert.Nil(t, st.f)
+}
+
+func TestBufferRouting(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	// 只写ERROR的文件不写缓存的日志，设置了Buffered的才写
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	errPath := filepath.Join(dir, "error.log")
+	bufPath := filepath.Join(dir, "buffered.log")
+	assert.Nil(t, Init(&Config{
+		File: &FileLogConfig{Path: path, Level: "INFO"},
+		Files: []*FileLogConfig{
+			{Path: errPath, Level: "ERROR"},
+			{Path: bufPath, Level: "ERROR", Buffered: true},
+		},
+	}))
+
+	b := NewBuffer(&BufferOptions{Module: "req"})
+	b.Debug("buffered debug")
+	b.Error("boom")
+	b.Finish(errors.New("failed"))
+
+	for _, p := range []string{path, errPath, bufPath} {
+		assert.True(t, strings.Contains(readFile(t, p), "boom"), p)
+	}
+	assert.True(t, strings.Contains(readFile(t, path), "buffered debug"))
+	assert.False(t, strings.Contains(readFile(t, errPath), "buffered debug"))
+	assert.True(t, strings.Contains(readFile(t, bufPath), "buffered debug"))
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestTimeFormat(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	clock := &fakeClock{now: time.Date(2022, 2, 16, 8, 30, 0, 120000000, time.UTC)}
+	SetClock(clock)
+	path := filepath.Join(t.TempDir(), "time.log")
+	SetFileLog(path, "INFO")
+
+	cases := []struct {
+		format, zone, expect string
+	}{
+		{"", "utc", "2022-02-16 08:30:00.120000|"},
+		{"rfc3339nano", "utc", "2022-02-16T08:30:00.12Z|"},
+		{"rfc3339", "Asia/Shanghai", "2022-02-16T16:30:00+08:00|"},
+		{"epochmillis", "", "1645000200120|"},
+		{"15:04:05", "utc", "08:30:00|"},
+	}
+	for _, c := range cases {
+		os.Truncate(path, 0)
+		SetTimeFormat(c.format)
+		assert.Nil(t, SetTimeZone(c.zone))
+		Info("time")
+		assert.True(t, strings.HasPrefix(readFile(t, path), c.expect), c.format+": "+readFile(t, path))
+	}
+	assert.NotNil(t, SetTimeZone("No/Such_Zone"))
+
+	os.Truncate(path, 0)
+	for i := 0; i < 5; i++ {
+		Every(time.Minute).Info("every minute %d", i)
+		clock.Add(30 * time.Second)
+	}
+	content := readFile(t, path)
+	assert.Equal(t, 3, strings.Count(content, "every minute"), content)
+}
+
+// TestSharedRotation 两个独立打开的文件日志写同一个文件，相当于两个进程，滚动时不能丢日志
+func TestSharedRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.log")
+	line := []byte(strings.Repeat("x", 1000) + "\n")
+	const lines = 3000
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		fl := &fileLogger{
+			on:         true,
+			name:       path,
+			level:      INFO,
+			maxSize:    1024 * 1024,
+			maxFileNum: 20,
+			fileMode:   0666,
+			uid:        -1,
+			gid:        -1,
+			state:      &fileState{},
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				outputToFile(load(), fl, INFO, line)
+			}
+			fl.state.close()
+		}()
+	}
+	wg.Wait()
+
+	names, _ := filepath.Glob(path + "*")
+	total := 0
+	for _, name := range names {
+		if strings.HasSuffix(name, ".lock") {
+			continue
+		}
+		total += strings.Count(readFile(t, name), "\n")
+	}
+	assert.Equal(t, 2*lines, total)
+	assert.True(t, len(names) >= 4, "should rotate: %v", names)
+}
+
+func TestFileFallback(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+
+	saved := load()
+	defer dl.Store(saved)
+
+	var errs []*SinkError
+	SetErrorHandler(func(e *SinkError) {
+		errs = append(errs, e)
+	})
+
+	path := filepath.Join(t.TempDir(), "fallback.log")
+	Init(&Config{
+		File: &FileLogConfig{
+			Path:      path,
+			Level:     "INFO",
+			Sync:      "level",
+			SyncLevel: "ERROR",
+			Fallback:  "ring",
+			RingSize:  2,
+		},
+	})
+	st := load().files[0].state
+
+	Error("line 1")
+	// 模拟磁盘满
+	st.f.Close()
+	st.f, _ = os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	Info("line 2")
+	Info("line 3")
+	Info("line 4")
+	assert.Equal(t, 1, len(errs))
+	assert.NotNil(t, errs[0].Err)
+
+	st.failedAt = time.Time{}
+	Info("line 5")
+	assert.Equal(t, 2, len(errs))
+	assert.Nil(t, errs[1].Err)
+
+	content := readFile(t, path)
+	assert.True(t, strings.Contains(content, "line 1"), content)
+	assert.False(t, strings.Contains(content, "line 2"), content)
+	assert.True(t, strings.Index(content, "line 3") < strings.Index(content, "line 4"), content)
+	assert.True(t, strings.Index(content, "line 4") < strings.Index(content, "line 5"), content)
+
+	// 不是磁盘满或者IO错误时不写到fallback
+	st.f.Close()
+	before := GetMetrics()
+	Info("line 6")
+	assert.Equal(t, 3, len(errs))
+	assert.False(t, errors.Is(errs[2], syscall.ENOSPC))
+	assert.Equal(t, 0, len(st.ring))
+	assert.Equal(t, before.FallbackDrops+1, GetMetrics().FallbackDrops)
+}
+
+func TestFileSyncInterval(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	path := filepath.Join(t.TempDir(), "sync.log")
+	Init(&Config{
+		File: &FileLogConfig{Path: path, Level: "INFO", Sync: "interval", SyncInterval: 50 * time.Millisecond},
+	})
+	st := load().files[0].state
+
+	Info("line 1")
+	Info("line 2")
+	st.mu.Lock()
+	assert.True(t, st.dirty)
+	synced := st.lastSync
+	st.mu.Unlock()
+
+	// 没有新日志时间隔到了也要刷盘
+	time.Sleep(200 * time.Millisecond)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	assert.False(t, st.dirty)
+	assert.True(t, st.lastSync.After(synced))
+	assert.Nil(t, st.syncTimer)
+}
+
+func TestFileDiskFull(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+
+	saved := load()
+	defer dl.Store(saved)
+
+	var errs []*SinkError
+	SetErrorHandler(func(e *SinkError) {
+		errs = append(errs, e)
+	})
+	SetFileLog("/dev/full", "INFO")
+	defer load().files[0].state.close()
+
+	before := GetMetrics()
+	Info("disk full")
+	Info("disk still full")
+	assert.Equal(t, 1, len(errs))
+	assert.True(t, errors.Is(errs[0], syscall.ENOSPC), errs[0].Error())
+	assert.Equal(t, before.FallbackDrops+2, GetMetrics().FallbackDrops)
+}
+
+func TestFileCreateDir(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	dir := filepath.Join(t.TempDir(), "a", "b")
+	path := filepath.Join(dir, "create.log")
+	err := Init(&Config{
+		File: &FileLogConfig{
+			Path:      path,
+			Level:     "INFO",
+			CreateDir: true,
+			FileMode:  0600,
+			DirMode:   0700,
+			Owner:     fmt.Sprint(os.Getuid()),
+		},
+	})
+	defer load().files[0].state.close()
+	assert.Nil(t, err)
+
+	fi, err := os.Stat(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+
+	Info("created")
+	assert.True(t, strings.Contains(readFile(t, path), "created"))
+	fi, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// 上级是普通文件时Init返回错误
+	err = Init(&Config{
+		File: &FileLogConfig{
+			Path:      filepath.Join(path, "bad.log"),
+			Level:     "INFO",
+			CreateDir: true,
+		},
+	})
+	assert.True(t, errors.Is(err, syscall.ENOTDIR), fmt.Sprint(err))
+
+	err = Init(&Config{
+		File: &FileLogConfig{Path: path, Owner: "no-such-user-for-log"},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestFileHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "header.log")
+	fl := &fileLogger{
+		on:         true,
+		name:       path,
+		level:      INFO,
+		maxSize:    64 * 1024,
+		maxFileNum: 3,
+		header:     true,
+		fileMode:   0666,
+		uid:        -1,
+		gid:        -1,
+		state:      &fileState{},
+	}
+	defer fl.state.close()
+
+	line := []byte(strings.Repeat("x", 99) + "\n")
+	for i := 0; i < 2*checkLines; i++ {
+		outputToFile(load(), fl, INFO, line)
+		if _, err := os.Stat(path + ".1"); err == nil {
+			break
+		}
+	}
+	outputToFile(load(), fl, INFO, []byte("after rotation\n"))
+
+	old := strings.Split(strings.TrimSpace(readFile(t, path+".1")), "\n")
+	assert.True(t, strings.Contains(old[0], "log file header"), old[0])
+	assert.True(t, strings.Contains(old[0], fmt.Sprintf("pid=%d", os.Getpid())), old[0])
+	assert.True(t, strings.Contains(old[0], "max_file_num=3"), old[0])
+	assert.True(t, strings.Contains(old[len(old)-1], "log file trailer"), old[len(old)-1])
+
+	cur := strings.Split(strings.TrimSpace(readFile(t, path)), "\n")
+	assert.True(t, strings.Contains(cur[0], "log file header"), cur[0])
+	assert.Equal(t, "after rotation", cur[len(cur)-1])
+}
+
+func TestRules(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	path := filepath.Join(t.TempDir(), "rules.log")
+	err := Init(&Config{
+		File: &FileLogConfig{
+			Path:  path,
+			Level: "INFO",
+			Rules: []*RuleConfig{
+				{Action: "drop", Module: "noisy"},
+				{Action: "keep", Level: "DEBUG", Message: "auth"},
+				{Action: "drop", Func: "TestRules", Message: "secret"},
+			},
+		},
+	})
+	defer load().files[0].state.close()
+	assert.Nil(t, err)
+	assert.Equal(t, DEBUG, load().minLevel)
+
+	before := GetMetrics()
+	Info("normal line")
+	New("noisy").Error("noisy auth line")
+	Debug("auth debug line")
+	Debug("other debug line")
+	Verbose("auth verbose line")
+	Info("secret line")
+
+	content := readFile(t, path)
+	assert.True(t, strings.Contains(content, "normal line"), content)
+	assert.False(t, strings.Contains(content, "noisy"), content)
+	assert.True(t, strings.Contains(content, "auth debug line"), content)
+	assert.False(t, strings.Contains(content, "other debug line"), content)
+	assert.False(t, strings.Contains(content, "auth verbose line"), content)
+	assert.False(t, strings.Contains(content, "secret"), content)
+
+	// 被规则丢掉的不算输出的行数
+	after := GetMetrics()
+	assert.Equal(t, before.Lines["INFO"]+1, after.Lines["INFO"])
+	assert.Equal(t, before.Lines["ERROR"], after.Lines["ERROR"])
+	assert.Equal(t, before.Lines["DEBUG"]+1, after.Lines["DEBUG"])
+	assert.Equal(t, before.Filtered+3, after.Filtered)
+
+	err = SetStdRules([]*RuleConfig{{Action: "keep", Message: "("}, {Action: "ignore"}})
+	assert.NotNil(t, err)
+}
+
+func TestRemoteInitError(t *testing.T) {
+	saved := load()
+	defer dl.Store(saved)
+
+	// 队列设置有错时Init返回错误，不会启动agent
+	err := Init(&Config{Remote: &RemoteLogConfig{Level: "INFO", Overflow: "spill"}})
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "spill path"), err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&remoteReady))
+	assert.False(t, remoteInitialized)
+
+	err = SetRemoteLog(&RemoteLogConfig{Level: "INFO", Overflow: "bogus"})
+	assert.NotNil(t, err)
+}
+
+func TestAgentStartupFailure(t *testing.T) {
+	t.Setenv("LOG_AGENT_PATH", "/bin/false")
+	backoff := agentBackoff
+	agentBackoff = 10 * time.Millisecond
+	defer func() { agentBackoff = backoff }()
+
+	// agent启动时就退出，重启一次后关闭远端log
+	atomic.StoreInt32(&remoteReady, 1)
+	done := make(chan struct{})
+	go func() {
+		forkExec("", nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("agent restarted forever")
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&remoteReady))
+}
@@ -0,0 +1,146 @@
+package log
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/plexsec/utils/stat"
+)
+
+// 日志输出，用于统计
+const (
+	sinkStd = iota
+	sinkRemote
+	sinkMax
+)
+
+var sinkNames = [sinkMax]string{"std", "remote"}
+
+// counters 日志模块自身的统计，都是累计值
+type counters struct {
+	lines       [FATAL + 1]int64 // 各级别输出的行数，不算被规则丢掉的
+	filtered    int64            // 格式化后被各输出的规则丢掉、钩子也没收的行数
+	sinks       [sinkMax]int64   // 标准输出和远程日志写入的行数
+	files       sync.Map         // 各文件日志写入的行数，文件名->*int64
+	writeErrors int64            // 写文件或远程队列失败的次数
+	remoteDrops int64            // 远程队列满丢弃的行数
+	rotations   int64            // 文件滚动的次数
+	hookDrops   int64            // 钩子队列满丢弃的记录数
+	hookPanics  int64            // 钩子panic的次数
+
+	fallbackDrops int64 // 写文件失败后丢弃的行数
+}
+
+var metrics counters
+
+func countLine(level Level) {
+	if level >= OFF && level <= FATAL {
+		atomic.AddInt64(&metrics.lines[level], 1)
+	}
+}
+
+func countSink(sink int) {
+	atomic.AddInt64(&metrics.sinks[sink], 1)
+}
+
+func countFile(name string) {
+	n, ok := metrics.files.Load(name)
+	if !ok {
+		n, _ = metrics.files.LoadOrStore(name, new(int64))
+	}
+	atomic.AddInt64(n.(*int64), 1)
+}
+
+// Metrics 日志模块自身的统计，都是进程启动以来的累计值
+type Metrics struct {
+	Lines       map[string]int64 // 各级别输出的行数，不算被规则丢掉的
+	Filtered    int64            // 被各输出的规则丢掉、钩子也没收的行数
+	Sinks       map[string]int64 // 各输出写入的行数，std、remote和各文件日志的文件名
+	WriteErrors int64            // 写文件或远程队列失败的次数
+	RemoteDrops int64            // 远程队列满丢弃的行数
+	Rotations   int64            // 文件滚动的次数
+	HookDrops   int64            // 钩子队列满丢弃的记录数
+	HookPanics  int64            // 钩子panic的次数
+
+	FallbackDrops int64 // 写文件失败后丢弃的行数
+}
+
+// GetMetrics 取日志模块自身的统计
+func GetMetrics() Metrics {
+	m := Metrics{
+		Lines:       make(map[string]int64, len(metrics.lines)),
+		Sinks:       make(map[string]int64, len(sinkNames)),
+		Filtered:    atomic.LoadInt64(&metrics.filtered),
+		WriteErrors: atomic.LoadInt64(&metrics.writeErrors),
+		RemoteDrops: atomic.LoadInt64(&metrics.remoteDrops),
+		Rotations:   atomic.LoadInt64(&metrics.rotations),
+		HookDrops:   atomic.LoadInt64(&metrics.hookDrops),
+		HookPanics:  atomic.LoadInt64(&metrics.hookPanics),
+
+		FallbackDrops: atomic.LoadInt64(&metrics.fallbackDrops),
+	}
+	for l := VERBOSE; l <= FATAL; l++ {
+		m.Lines[l.name()] = atomic.LoadInt64(&metrics.lines[l])
+	}
+	for i, name := range sinkNames {
+		m.Sinks[name] = atomic.LoadInt64(&metrics.sinks[i])
+	}
+	metrics.files.Range(func(name, n interface{}) bool {
+		m.Sinks[name.(string)] = atomic.LoadInt64(n.(*int64))
+		return true
+	})
+	return m
+}
+
+// 上次上报时的值，stat按周期累加，所以只报增量
+var (
+	published     Metrics
+	publishedLock sync.Mutex
+)
+
+// statAdd 上报属性，测试时替换
+var statAdd = stat.Add
+
+// sinkLabel 上报用的输出名，stat按.拆分属性名，文件日志用file_加文件名，.等字符换成_
+func sinkLabel(name string) string {
+	if name == "std" || name == "remote" {
+		return name
+	}
+
+	b := []byte("file_" + filepath.Base(name))
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// publishMetrics 由stat每个周期调用，上报为log.lines.LEVEL、log.sink.NAME等属性，NAME见sinkLabel
+func publishMetrics() {
+	publishedLock.Lock()
+	defer publishedLock.Unlock()
+
+	m := GetMetrics()
+	for name, v := range m.Lines {
+		statAdd("log.lines."+strings.ToLower(name), v-published.Lines[name])
+	}
+	for name, v := range m.Sinks {
+		statAdd("log.sink."+sinkLabel(name), v-published.Sinks[name])
+	}
+	statAdd("log.lines.filtered", m.Filtered-published.Filtered)
+	statAdd("log.errors.write", m.WriteErrors-published.WriteErrors)
+	statAdd("log.errors.remote_drop", m.RemoteDrops-published.RemoteDrops)
+	statAdd("log.rotations", m.Rotations-published.Rotations)
+	statAdd("log.errors.hook_drop", m.HookDrops-published.HookDrops)
+	statAdd("log.errors.hook_panic", m.HookPanics-published.HookPanics)
+	statAdd("log.errors.fallback_drop", m.FallbackDrops-published.FallbackDrops)
+
+	published = m
+}
+
+func init() {
+	stat.RegisterCollector(publishMetrics)
+}
@@ -0,0 +1,334 @@
+package rlog
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/plexsec/utils/log/shm"
+)
+
+// Lane 一个通道，级别不低于MinLevel的日志写到MinLevel最高的那个通道，读的时候先读MinLevel高的通道
+// 级别和log.Level一致，都高于日志级别时写到MinLevel最低的通道
+type Lane struct {
+	MinLevel int
+	Capacity int // 环形缓冲区的字节数，按8字节对齐
+}
+
+// 最多的通道数
+const maxLanes = 8
+
+// laneHeader 段头里每个通道的读写位置，64字节，不同通道不共用cache line
+type laneHeader struct {
+	minLevel     int64
+	capacity     uint64
+	writeIndex   uint64
+	readIndex    uint64
+	spaceFutex   uint32 // 通道满时写的进程在上面等待，读走日志时加1
+	spaceWaiters uint32 // 在spaceFutex上等待的写进程数
+	_            [3]uint64
+}
+
+// lane 一个通道的环形缓冲区
+type lane struct {
+	hdr        *laneHeader
+	writeIndex *uint64
+	readIndex  *uint64
+	minLevel   int
+	capacity   uint64
+	maxRecord  uint64 // 记录内容最多的字节数
+	data       []byte
+
+	// 读位置上一直没有发布的记录，超过abandonTimeout认为写的进程已经退出
+	stuckMu    sync.Mutex
+	stuckPos   uint64
+	stuckSince time.Time
+}
+
+func newLane(hdr *laneHeader, minLevel, maxMessage int, data []byte) *lane {
+	return &lane{
+		hdr:        hdr,
+		writeIndex: &hdr.writeIndex,
+		readIndex:  &hdr.readIndex,
+		minLevel:   minLevel,
+		capacity:   uint64(len(data)),
+		maxRecord:  uint64(crcSize + maxMessage),
+		data:       data,
+	}
+}
+
+// reset 清空通道
+func (l *lane) reset() {
+	atomic.StoreUint64(l.readIndex, 0)
+	atomic.StoreUint64(l.writeIndex, 0)
+	atomic.StoreUint32(&l.hdr.spaceWaiters, 0)
+	for i := range l.data {
+		l.data[i] = 0
+	}
+	l.hdr.minLevel = int64(l.minLevel)
+	l.hdr.capacity = l.capacity
+}
+
+// header 取位置pos处的记录头
+func (l *lane) header(pos uint64) *uint64 {
+	return (*uint64)(unsafe.Pointer(&l.data[pos%l.capacity]))
+}
+
+func (l *lane) empty() bool {
+	readIndex := atomic.LoadUint64(l.readIndex)
+	if readIndex == atomic.LoadUint64(l.writeIndex) {
+		return true
+	}
+	return atomic.LoadUint64(l.header(readIndex))&recordCommit == 0
+}
+
+// full 最长的日志写不进去
+func (l *lane) full(maxMessage int) bool {
+	readIndex := atomic.LoadUint64(l.readIndex)
+	writeIndex := atomic.LoadUint64(l.writeIndex)
+	return writeIndex+uint64(recordSize(crcSize+maxMessage)) > readIndex+l.capacity
+}
+
+// reserve 占住size字节的空间，返回记录的位置，末尾放不下时先写回绕标记，cas失败时重试retry次
+// 占住后马上把size写到记录头，不带recordCommit，写的进程退出时读的进程按它跳过
+func (l *lane) reserve(size uint64, retry *int) (uint64, error) {
+	// 先读readIndex，保证readIndex不会大于writeIndex
+	readIndex := atomic.LoadUint64(l.readIndex)
+	writeIndex := atomic.LoadUint64(l.writeIndex)
+
+	if tail := l.capacity - writeIndex%l.capacity; tail < size {
+		// 末尾放不下，先把到末尾的空间用回绕标记占住
+		if writeIndex+tail > readIndex+l.capacity {
+			return 0, ErrorQueryFull
+		}
+		if atomic.CompareAndSwapUint64(l.writeIndex, writeIndex, writeIndex+tail) {
+			atomic.StoreUint64(l.header(writeIndex), recordCommit|recordWrap|tail)
+		} else if *retry--; *retry < 0 {
+			return 0, ErrorRetryError
+		}
+		return l.reserve(size, retry)
+	}
+
+	if writeIndex+size > readIndex+l.capacity {
+		// 队列满了
+		return 0, ErrorQueryFull
+	}
+
+	if !atomic.CompareAndSwapUint64(l.writeIndex, writeIndex, writeIndex+size) {
+		// 被别的进程抢先了，重试一次咯
+		if *retry--; *retry < 0 {
+			return 0, ErrorRetryError
+		}
+		return l.reserve(size, retry)
+	}
+	atomic.StoreUint64(l.header(writeIndex), size)
+	return writeIndex, nil
+}
+
+// release 清零读完的记录，推进读位置，把空间还给写的进程
+func (l *lane) release(pos, size uint64) {
+	off := pos % l.capacity
+	for i := off + 8; i < off+size; i++ {
+		l.data[i] = 0
+	}
+	atomic.StoreUint64(l.header(pos), 0)
+	atomic.StoreUint64(l.readIndex, pos+size)
+
+	// 有写进程在等空间时唤醒
+	if atomic.LoadUint32(&l.hdr.spaceWaiters) != 0 {
+		atomic.AddUint32(&l.hdr.spaceFutex, 1)
+		shm.FutexWake(&l.hdr.spaceFutex, math.MaxInt32)
+	}
+}
+
+// claim 用cas占住读位置上已发布的记录，返回读位置和记录头
+// 读的进程和覆盖旧日志的写进程都通过它拿记录，拿到的进程负责release
+func (l *lane) claim() (pos, h uint64, err error) {
+	pos = atomic.LoadUint64(l.readIndex)
+	if pos == atomic.LoadUint64(l.writeIndex) {
+		err = ErrorQueryEmpty
+		return
+	}
+
+	header := l.header(pos)
+	h = atomic.LoadUint64(header)
+	if h&recordCommit == 0 {
+		// 写的进程还没写完
+		err = ErrorQueryEmpty
+		return
+	}
+	if h&recordClaim != 0 || !atomic.CompareAndSwapUint64(header, h, h|recordClaim) {
+		// 别的进程正在读
+		err = ErrorCasError
+		return
+	}
+
+	// 读位置已经被别的进程推进了，占住的是后来写在同一个地方的记录，放回去
+	if atomic.LoadUint64(l.readIndex) != pos {
+		atomic.StoreUint64(header, h)
+		err = ErrorCasError
+	}
+	return
+}
+
+// 写的进程占住空间后超过这个时间还没发布，认为它已经退出
+const abandonTimeout = time.Second
+
+// corruptError 跳过的损坏记录
+type corruptError struct {
+	reason    string
+	pos       uint64
+	data      []byte
+	abandoned bool // 写的进程占住空间后没有发布
+}
+
+func (err *corruptError) Error() string {
+	return fmt.Sprintf("rlog: corrupt record at %d: %s", err.pos, err.reason)
+}
+
+// size 检查pos处的记录头，返回记录占的字节数，不对时返回0
+func (l *lane) size(pos, h uint64) uint64 {
+	if h&^(recordCommit|recordWrap|recordClaim|recordLength) != 0 {
+		return 0
+	}
+	n := h & recordLength
+	tail := l.capacity - pos%l.capacity
+	size := n
+	if h&recordWrap != 0 {
+		// 回绕标记到缓冲区末尾
+		if n != tail {
+			return 0
+		}
+	} else if size = uint64(recordSize(int(n))); n < crcSize+recordFixed || n > l.maxRecord || size > tail {
+		// 记录不会跨过缓冲区末尾
+		return 0
+	}
+	if pos+size > atomic.LoadUint64(l.writeIndex) {
+		return 0
+	}
+	return size
+}
+
+// body 取pos处记录的内容
+func (l *lane) body(pos, h uint64) []byte {
+	off := pos%l.capacity + 8
+	return l.data[off : off+h&recordLength]
+}
+
+func (l *lane) read() (*Record, error) {
+	pos, h, err := l.claim()
+	if err == ErrorQueryEmpty && l.abandoned(pos) {
+		if !atomic.CompareAndSwapUint64(l.header(pos), h, h|recordClaim) {
+			return nil, ErrorCasError
+		}
+		// 记录头上有占住的大小时只跳过这条，写的进程在写记录头之前退出时往后找
+		var ce *corruptError
+		if size := l.pending(pos, h); size != 0 {
+			ce = l.drop(pos, size, "abandoned by writer")
+		} else {
+			ce = l.skip(pos, "abandoned by writer")
+		}
+		ce.abandoned = true
+		return nil, ce
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	size := l.size(pos, h)
+	if size == 0 {
+		return nil, l.skip(pos, fmt.Sprintf("bad header %#x", h))
+	}
+	if h&recordWrap != 0 {
+		l.release(pos, size)
+		return l.read()
+	}
+
+	r, err := decodeBody(l.body(pos, h))
+	if err != nil {
+		err = &corruptError{reason: err.Error(), pos: pos, data: append([]byte(nil), l.body(pos, h)...)}
+	}
+	l.release(pos, size)
+	return r, err
+}
+
+// abandoned 读位置上的记录是不是一直没有发布
+func (l *lane) abandoned(pos uint64) bool {
+	l.stuckMu.Lock()
+	defer l.stuckMu.Unlock()
+
+	if pos == atomic.LoadUint64(l.writeIndex) {
+		l.stuckSince = time.Time{}
+		return false
+	}
+	if pos != l.stuckPos || l.stuckSince.IsZero() {
+		l.stuckPos, l.stuckSince = pos, time.Now()
+		return false
+	}
+	return time.Since(l.stuckSince) > abandonTimeout
+}
+
+// pending 检查pos处写的进程占住还没发布的记录头，返回占的字节数，不对时返回0
+func (l *lane) pending(pos, h uint64) uint64 {
+	if h == 0 || h&^recordLength != 0 || h%8 != 0 || h > l.capacity-pos%l.capacity ||
+		pos+h > atomic.LoadUint64(l.writeIndex) {
+		return 0
+	}
+	return h
+}
+
+// skip 跳过已经占住的pos处的损坏记录，往后找下一条完好的记录或者别的写进程占住还没发布的记录
+// 找不到时跳到缓冲区末尾或者写位置
+func (l *lane) skip(pos uint64, reason string) *corruptError {
+	end := pos + l.capacity - pos%l.capacity
+	if writeIndex := atomic.LoadUint64(l.writeIndex); writeIndex < end {
+		end = writeIndex
+	}
+
+	next := pos + 8
+	for ; next < end; next += 8 {
+		h := atomic.LoadUint64(l.header(next))
+		if h&recordCommit == 0 {
+			if l.pending(next, h) != 0 {
+				break
+			}
+			continue
+		}
+		if h&recordClaim != 0 || l.size(next, h) == 0 {
+			continue
+		}
+		if h&recordWrap != 0 || checksum(l.body(next, h)) {
+			break
+		}
+	}
+
+	return l.drop(pos, next-pos, reason)
+}
+
+// drop 记下pos处size字节的原始内容后释放
+func (l *lane) drop(pos, size uint64, reason string) *corruptError {
+	off := pos % l.capacity
+	err := &corruptError{reason: reason, pos: pos, data: append([]byte(nil), l.data[off:off+size]...)}
+	l.release(pos, size)
+	return err
+}
+
+// discardOldest 丢弃最早的一条日志，拿不到时返回false，丢弃的是回绕标记时discarded为false
+// 损坏的记录留给读的进程处理
+func (l *lane) discardOldest() (ok, discarded bool) {
+	pos, h, err := l.claim()
+	if err != nil {
+		return false, false
+	}
+
+	size := l.size(pos, h)
+	if size == 0 {
+		atomic.StoreUint64(l.header(pos), h)
+		return false, false
+	}
+	l.release(pos, size)
+	return true, h&recordWrap == 0
+}
@@ -0,0 +1,108 @@
+package rlog
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// 时间格式传给agent的环境变量
+const (
+	envTimeLayout = "LOG_AGENT_TIME_LAYOUT"
+	envTimeUnit   = "LOG_AGENT_TIME_UNIT"
+	envTimeZone   = "LOG_AGENT_TIME_ZONE"
+)
+
+// 默认的时间格式，和log的默认格式一致
+const defaultTimeLayout = "2006-01-02 15:04:05.000000"
+
+// 和log.Level一致
+var levelNames = []string{"OFF", "VERBOSE", "DEBUG", "INFO", "WARN", "ERROR", "CRITICAL", "FATAL"}
+
+// LineFormat 把记录格式化成一行文本的设置，agent发给kafka和写日志的进程spill时共用
+// 一行为 主机|时间|级别|模块|文件:行号 函数|内容，和旧版本agent的格式一致，字段以" key=value"接在内容后面
+type LineFormat struct {
+	Host   string         // 第一列，为空时用写日志进程的pid
+	Layout string         // 时间的time.Format格式，为空时用2006-01-02 15:04:05.000000
+	Unit   time.Duration  // 不为0时时间输出为这个单位的epoch，不用Layout
+	Loc    *time.Location // 时区，为nil时用本地时区
+}
+
+// LineFormatFromEnv 读取写日志进程传过来的时间格式，主机为HOSTNAME
+func LineFormatFromEnv() *LineFormat {
+	f := &LineFormat{
+		Host:   os.Getenv("HOSTNAME"),
+		Layout: os.Getenv(envTimeLayout),
+	}
+	f.Unit, _ = time.ParseDuration(os.Getenv(envTimeUnit))
+	if zone := os.Getenv(envTimeZone); zone != "" {
+		f.Loc, _ = time.LoadLocation(zone)
+	}
+	return f
+}
+
+// Environ 时间格式转成传给agent的环境变量，nil时为空
+func (f *LineFormat) Environ() []string {
+	if f == nil {
+		return nil
+	}
+
+	var env []string
+	if f.Layout != "" {
+		env = append(env, envTimeLayout+"="+f.Layout)
+	}
+	if f.Unit != 0 {
+		env = append(env, envTimeUnit+"="+f.Unit.String())
+	}
+	if f.Loc != nil {
+		env = append(env, envTimeZone+"="+f.Loc.String())
+	}
+	return env
+}
+
+// AppendLine 把记录格式化成一行追加到b，以换行结尾
+func (f *LineFormat) AppendLine(b []byte, r *Record) []byte {
+	if f.Host != "" {
+		b = append(b, f.Host...)
+	} else {
+		b = strconv.AppendInt(b, int64(r.Pid), 10)
+	}
+	b = append(b, '|')
+
+	loc := f.Loc
+	if loc == nil {
+		loc = time.Local
+	}
+	switch {
+	case f.Unit != 0:
+		b = strconv.AppendInt(b, r.Time.UnixNano()/int64(f.Unit), 10)
+	case f.Layout != "":
+		b = r.Time.In(loc).AppendFormat(b, f.Layout)
+	default:
+		b = r.Time.In(loc).AppendFormat(b, defaultTimeLayout)
+	}
+	b = append(b, '|')
+
+	if r.Level >= 0 && r.Level < len(levelNames) {
+		b = append(b, levelNames[r.Level]...)
+	} else {
+		b = append(b, "NONE"...)
+	}
+	b = append(b, '|')
+	b = append(b, r.Module...)
+	b = append(b, '|')
+	b = append(b, r.File...)
+	b = append(b, ':')
+	b = strconv.AppendInt(b, int64(r.Line), 10)
+	b = append(b, ' ')
+	b = append(b, r.Func...)
+	b = append(b, '|')
+	b = append(b, r.Msg...)
+	for _, field := range r.Fields {
+		b = append(b, ' ')
+		b = append(b, field.Key...)
+		b = append(b, '=')
+		b = append(b, field.Value...)
+	}
+	return append(b, '\n')
+}
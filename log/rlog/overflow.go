@@ -0,0 +1,145 @@
+package rlog
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/plexsec/utils/log/shm"
+)
+
+// 队列满时的处理
+const (
+	overflowDropNewest = iota // 丢弃新的日志
+	overflowOverwrite         // 覆盖最早的日志
+	overflowBlock             // 等读的进程读走日志，超时后丢弃新的日志
+	overflowSpill             // 写到本地文件
+)
+
+// 覆盖旧日志时最多尝试的次数，读的进程正在读或者写的进程没写完时拿不到最早的日志
+const overwriteAttempts = 100
+
+// errSpilled 日志写到了本地文件，Write返回nil
+var errSpilled = &Error{
+	Value: -100,
+	msg:   "spilled",
+}
+
+func newOverflow(s string) (int, error) {
+	switch strings.ToLower(s) {
+	case "", "drop":
+		return overflowDropNewest, nil
+	case "overwrite":
+		return overflowOverwrite, nil
+	case "block":
+		return overflowBlock, nil
+	case "spill":
+		return overflowSpill, nil
+	}
+	return 0, fmt.Errorf("rlog: unknown overflow policy %q", s)
+}
+
+// Stats 队列满时各处理方式和跳过损坏记录的计数，在共享内存里，所有进程一起计数
+type Stats struct {
+	DroppedNewest uint64 // 丢弃的新日志，包括覆盖旧日志和写本地文件失败的
+	Overwritten   uint64 // 被覆盖的旧日志
+	BlockTimeouts uint64 // 等待超时丢弃的新日志
+	Spilled       uint64 // 写到本地文件的日志
+	Corrupted     uint64 // 读的进程跳过的损坏记录
+	Abandoned     uint64 // 读的进程跳过的写进程占住空间后没有发布的记录
+}
+
+// GetStats 取队列满时各处理方式的计数，没有Init时返回nil
+func GetStats() *Stats {
+	if query == nil {
+		return nil
+	}
+	return query.stats()
+}
+
+func (q *LogQuery) stats() *Stats {
+	return &Stats{
+		DroppedNewest: atomic.LoadUint64(&q.hdr.droppedNewest),
+		Overwritten:   atomic.LoadUint64(&q.hdr.overwritten),
+		BlockTimeouts: atomic.LoadUint64(&q.hdr.blockTimeouts),
+		Spilled:       atomic.LoadUint64(&q.hdr.spilled),
+		Corrupted:     atomic.LoadUint64(&q.hdr.corrupted),
+		Abandoned:     atomic.LoadUint64(&q.hdr.abandoned),
+	}
+}
+
+// overflow 通道l满时按设置处理，返回占到的位置，或者errSpilled、ErrorQueryFull
+func (q *LogQuery) overflow(l *lane, size uint64, retry *int, r *Record) (uint64, error) {
+	switch q.overflowPolicy {
+	case overflowOverwrite:
+		for i := 0; i < overwriteAttempts; i++ {
+			if ok, discarded := l.discardOldest(); !ok {
+				runtime.Gosched()
+			} else if discarded {
+				atomic.AddUint64(&q.hdr.overwritten, 1)
+			}
+			pos, err := l.reserve(size, retry)
+			if err != ErrorQueryFull {
+				return pos, err
+			}
+		}
+	case overflowBlock:
+		pos, err := q.waitSpace(l, size, retry)
+		if err != ErrorQueryFull {
+			return pos, err
+		}
+		atomic.AddUint64(&q.hdr.blockTimeouts, 1)
+		return 0, ErrorQueryFull
+	case overflowSpill:
+		if q.spill(r) == nil {
+			atomic.AddUint64(&q.hdr.spilled, 1)
+			return 0, errSpilled
+		}
+	}
+
+	atomic.AddUint64(&q.hdr.droppedNewest, 1)
+	return 0, ErrorQueryFull
+}
+
+// waitSpace 等读的进程读走通道l里的日志，直到占到空间或者超时
+func (q *LogQuery) waitSpace(l *lane, size uint64, retry *int) (uint64, error) {
+	deadline := time.Now().Add(q.blockTimeout)
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, ErrorQueryFull
+		}
+
+		// 先登记再试一次，读的进程推进读位置后看到spaceWaiters不为0就会唤醒
+		seq := atomic.LoadUint32(&l.hdr.spaceFutex)
+		atomic.AddUint32(&l.hdr.spaceWaiters, 1)
+		pos, err := l.reserve(size, retry)
+		if err == ErrorQueryFull {
+			shm.FutexWait(&l.hdr.spaceFutex, seq, wait)
+		}
+		atomic.AddUint32(&l.hdr.spaceWaiters, ^uint32(0))
+		if err != ErrorQueryFull {
+			return pos, err
+		}
+	}
+}
+
+// spill 把日志按spillFormat格式化后写到本地文件，不截断
+func (q *LogQuery) spill(r *Record) error {
+	q.spillMu.Lock()
+	defer q.spillMu.Unlock()
+
+	if q.spillFile == nil {
+		f, err := os.OpenFile(q.spillPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		q.spillFile = f
+	}
+
+	_, err := q.spillFile.Write(q.spillFormat.AppendLine(nil, r))
+	return err
+}
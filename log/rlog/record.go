@@ -0,0 +1,207 @@
+package rlog
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Record 队列里的一条日志
+type Record struct {
+	Time   time.Time
+	Level  int // 和log.Level一致
+	Pid    int
+	Tid    int
+	Module string
+	File   string
+	Line   int
+	Func   string
+	Msg    string
+	Fields []Field // 结构化的字段
+}
+
+// Field 日志的一个字段
+type Field struct {
+	Key   string
+	Value string
+}
+
+// 记录内容的格式，数都是小端：
+// 4字节crc32+编码后的记录，crc32为Castagnoli，只算后面编码的部分
+// 编码后的记录为8字节unix纳秒时间+1字节级别+4字节pid+4字节tid+module+file+uvarint行号+func+uvarint字段数+各字段的key、value+msg
+// 字符串为uvarint长度加内容
+const (
+	crcSize     = 4
+	recordFixed = 8 + 1 + 4 + 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	errBadRecord = &Error{
+		Value: -101,
+		msg:   "bad record",
+	}
+	errBadChecksum = &Error{
+		Value: -102,
+		msg:   "bad checksum",
+	}
+)
+
+func uvarintLen(n uint64) int {
+	size := 1
+	for ; n >= 0x80; n >>= 7 {
+		size++
+	}
+	return size
+}
+
+func stringLen(s string) int {
+	return uvarintLen(uint64(len(s))) + len(s)
+}
+
+// size 编码后的字节数
+func (r *Record) size() int {
+	n := recordFixed + stringLen(r.Module) + stringLen(r.File) + uvarintLen(uint64(uint32(r.Line))) +
+		stringLen(r.Func) + uvarintLen(uint64(len(r.Fields))) + stringLen(r.Msg)
+	for _, f := range r.Fields {
+		n += stringLen(f.Key) + stringLen(f.Value)
+	}
+	return n
+}
+
+// trim 截断到编码后不超过max字节，先截msg，还放不下时去掉字段和调用位置，最后截module
+func (r *Record) trim(max int) {
+	over := r.size() - max
+	if over <= 0 {
+		return
+	}
+	if over <= len(r.Msg) {
+		r.Msg = r.Msg[:len(r.Msg)-over]
+		return
+	}
+
+	r.Msg, r.Fields, r.File, r.Line, r.Func = "", nil, "", 0, ""
+	if over = r.size() - max; over > 0 {
+		r.Module = r.Module[:len(r.Module)-over]
+	}
+}
+
+// encode 编码到b，b的长度为r.size()
+func (r *Record) encode(b []byte) {
+	binary.LittleEndian.PutUint64(b[0:8], uint64(r.Time.UnixNano()))
+	b[8] = byte(r.Level)
+	binary.LittleEndian.PutUint32(b[9:13], uint32(r.Pid))
+	binary.LittleEndian.PutUint32(b[13:17], uint32(r.Tid))
+	b = b[recordFixed:]
+
+	putString := func(s string) {
+		n := binary.PutUvarint(b, uint64(len(s)))
+		b = b[n+copy(b[n:], s):]
+	}
+	putString(r.Module)
+	putString(r.File)
+	b = b[binary.PutUvarint(b, uint64(uint32(r.Line))):]
+	putString(r.Func)
+	b = b[binary.PutUvarint(b, uint64(len(r.Fields))):]
+	for _, f := range r.Fields {
+		putString(f.Key)
+		putString(f.Value)
+	}
+	putString(r.Msg)
+}
+
+// encodeBody 编码到记录内容b，b的长度为crcSize+r.size()
+func (r *Record) encodeBody(b []byte) {
+	r.encode(b[crcSize:])
+	binary.LittleEndian.PutUint32(b, crc32.Checksum(b[crcSize:], crcTable))
+}
+
+func checksum(b []byte) bool {
+	return len(b) >= crcSize && binary.LittleEndian.Uint32(b) == crc32.Checksum(b[crcSize:], crcTable)
+}
+
+// decodeBody 检查crc32后解码记录内容
+func decodeBody(b []byte) (*Record, error) {
+	if !checksum(b) {
+		return nil, errBadChecksum
+	}
+	return decodeRecord(b[crcSize:])
+}
+
+// decodeRecord 解码编码后的记录，长度不对或者uvarint不是最短的编码时返回errBadRecord
+func decodeRecord(b []byte) (*Record, error) {
+	if len(b) < recordFixed {
+		return nil, errBadRecord
+	}
+	r := &Record{
+		Time:  time.Unix(0, int64(binary.LittleEndian.Uint64(b[0:8]))),
+		Level: int(b[8]),
+		Pid:   int(binary.LittleEndian.Uint32(b[9:13])),
+		Tid:   int(binary.LittleEndian.Uint32(b[13:17])),
+	}
+	b = b[recordFixed:]
+
+	bad := false
+	getUvarint := func() uint64 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 || n != uvarintLen(v) {
+			bad = true
+			return 0
+		}
+		b = b[n:]
+		return v
+	}
+	getString := func() string {
+		n := getUvarint()
+		if bad || n > uint64(len(b)) {
+			bad = true
+			return ""
+		}
+		s := string(b[:n])
+		b = b[n:]
+		return s
+	}
+
+	r.Module = getString()
+	r.File = getString()
+	if line := getUvarint(); line <= math.MaxUint32 {
+		r.Line = int(line)
+	} else {
+		bad = true
+	}
+	r.Func = getString()
+	// 每个字段至少两个字节
+	if n := getUvarint(); n > 0 && n <= uint64(len(b)/2) {
+		r.Fields = make([]Field, n)
+		for i := range r.Fields {
+			r.Fields[i].Key = getString()
+			r.Fields[i].Value = getString()
+		}
+	} else if n > 0 {
+		bad = true
+	}
+	r.Msg = getString()
+	if bad || len(b) != 0 {
+		return nil, errBadRecord
+	}
+	return r, nil
+}
+
+var pid = os.Getpid()
+
+// fill 填上没有设置的时间、pid和tid
+func (r *Record) fill() {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	if r.Pid == 0 {
+		r.Pid = pid
+	}
+	if r.Tid == 0 {
+		r.Tid = syscall.Gettid()
+	}
+}
@@ -1,8 +1,16 @@
 package rlog
 
 import (
-	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/plexsec/utils/log/shm"
@@ -39,149 +47,696 @@ var (
 		Value: -4,
 		msg:   "cas error",
 	}
+	// ErrorNotInit 还没有调用Init
+	ErrorNotInit = &Error{
+		Value: -5,
+		msg:   "not initialized",
+	}
+	// ErrorCorrupt 读到损坏的记录，已经跳过
+	ErrorCorrupt = &Error{
+		Value: -6,
+		msg:   "corrupt record",
+	}
+)
+
+// 默认设置，旧版本用的key 2上可能还有旧的agent在读，新格式换了默认key
+const (
+	DefaultKey        = 0x524c4f47 // "RLOG"
+	DefaultCapacity   = 2000000    // 和旧版本1000个2000字节的槽占的内存差不多
+	DefaultMaxMessage = 16 * 1024
+)
+
+// 旧版本固定1000个2000字节的槽的段，用同一个key时没有进程attach的会被删掉重建
+const (
+	legacyKey  = 2
+	legacySize = 4 + 4 + 1000*2000
+)
+
+// 传给agent的环境变量，agent按同样的设置打开队列
+const (
+	envKey        = "LOG_AGENT_SHM_KEY"
+	envPath       = "LOG_AGENT_SHM_PATH"
+	envCapacity   = "LOG_AGENT_CAPACITY"
+	envMaxMessage = "LOG_AGENT_MAX_MESSAGE"
+	envLanes      = "LOG_AGENT_LANES" // MinLevel:Capacity,MinLevel:Capacity
+	envQuarantine = "LOG_AGENT_QUARANTINE_PATH"
 )
 
-const maxQueryLength = 1000
+// Options 共享内存队列的设置，写日志的进程和agent要一致
+// 同一台机器上不相关的程序要用不同的Key或Path，否则会共用一个队列
+type Options struct {
+	Key        int    // SysV共享内存的key，为0时由Path生成，都为空时用DefaultKey
+	Path       string // 用ftok由该路径生成key，路径要存在
+	Capacity   int    // 环形缓冲区的字节数，按8字节对齐，默认DefaultCapacity
+	MaxMessage int    // 单条记录编码后最多的字节数，至少64，超过时截断msg，默认DefaultMaxMessage
+
+	// 按级别分的通道，高级别的日志不会因为低级别的日志太多被丢弃，最多8个
+	// 设置了时Capacity为各通道之和，为空时只有一个Capacity大小的通道
+	Lanes []Lane
+
+	// 队列满时的处理，只影响写日志的进程，不传给agent：
+	// drop(默认)丢弃新的日志，overwrite覆盖最早的日志，block等待BlockTimeout，spill写到SpillPath
+	// 有多个通道时只处理日志要写的那个通道
+	Overflow     string
+	BlockTimeout time.Duration // 默认100ms
+	SpillPath    string
+	SpillFormat  *LineFormat // spill的一行的格式，和agent发给kafka的一致，为nil时用默认的时间格式
+
+	// 读的进程跳过损坏的记录时把原始内容追加到这个文件，为空时只计数
+	QuarantinePath string
+}
+
+// OptionsFromEnv 读取写日志进程传过来的设置，没有设置的用默认值
+func OptionsFromEnv() *Options {
+	atoi := func(name string) int {
+		n, _ := strconv.Atoi(os.Getenv(name))
+		return n
+	}
+	opts := &Options{
+		Key:            atoi(envKey),
+		Path:           os.Getenv(envPath),
+		Capacity:       atoi(envCapacity),
+		MaxMessage:     atoi(envMaxMessage),
+		QuarantinePath: os.Getenv(envQuarantine),
+	}
+	if lanes := os.Getenv(envLanes); lanes != "" {
+		for _, s := range strings.Split(lanes, ",") {
+			var lane Lane
+			if _, err := fmt.Sscanf(s, "%d:%d", &lane.MinLevel, &lane.Capacity); err == nil {
+				opts.Lanes = append(opts.Lanes, lane)
+			}
+		}
+	}
+	return opts
+}
+
+// Environ 转成传给agent的环境变量，nil时为空
+func (o *Options) Environ() []string {
+	if o == nil {
+		return nil
+	}
+
+	var env []string
+	if o.Key != 0 {
+		env = append(env, fmt.Sprintf("%s=%d", envKey, o.Key))
+	}
+	if o.Path != "" {
+		env = append(env, envPath+"="+o.Path)
+	}
+	if o.Capacity != 0 {
+		env = append(env, fmt.Sprintf("%s=%d", envCapacity, o.Capacity))
+	}
+	if o.MaxMessage != 0 {
+		env = append(env, fmt.Sprintf("%s=%d", envMaxMessage, o.MaxMessage))
+	}
+	if len(o.Lanes) > 0 {
+		lanes := make([]string, len(o.Lanes))
+		for i, lane := range o.Lanes {
+			lanes[i] = fmt.Sprintf("%d:%d", lane.MinLevel, lane.Capacity)
+		}
+		env = append(env, envLanes+"="+strings.Join(lanes, ","))
+	}
+	if o.QuarantinePath != "" {
+		env = append(env, envQuarantine+"="+o.QuarantinePath)
+	}
+	return env
+}
+
+// normalize 填上默认值并检查设置，返回共享内存的key，通道按MinLevel从低到高排好
+func (o *Options) normalize() (opts Options, key uintptr, err error) {
+	if o != nil {
+		opts = *o
+	}
+	if opts.Capacity == 0 {
+		opts.Capacity = DefaultCapacity
+	}
+	if opts.MaxMessage == 0 {
+		opts.MaxMessage = DefaultMaxMessage
+	}
+	if opts.BlockTimeout <= 0 {
+		opts.BlockTimeout = 100 * time.Millisecond
+	}
+
+	if opts.MaxMessage < 64 || opts.MaxMessage > 1<<30 {
+		err = fmt.Errorf("rlog: invalid max message %d", opts.MaxMessage)
+		return
+	}
+
+	if len(opts.Lanes) == 0 {
+		opts.Lanes = []Lane{{Capacity: opts.Capacity}}
+	}
+	if len(opts.Lanes) > maxLanes {
+		err = fmt.Errorf("rlog: too many lanes %d, at most %d", len(opts.Lanes), maxLanes)
+		return
+	}
+	lanes := make([]Lane, len(opts.Lanes))
+	copy(lanes, opts.Lanes)
+	sort.Slice(lanes, func(i, j int) bool { return lanes[i].MinLevel < lanes[j].MinLevel })
+	opts.Lanes, opts.Capacity = lanes, 0
+	for i := range lanes {
+		if i > 0 && lanes[i].MinLevel == lanes[i-1].MinLevel {
+			err = fmt.Errorf("rlog: duplicate lane min level %d", lanes[i].MinLevel)
+			return
+		}
+		lanes[i].Capacity = align(lanes[i].Capacity)
+		// 最长的记录要能放得下，还要留点空间给别的记录
+		if lanes[i].Capacity < 2*recordSize(crcSize+opts.MaxMessage) {
+			err = fmt.Errorf("rlog: capacity %d too small for max message %d", lanes[i].Capacity, opts.MaxMessage)
+			return
+		}
+		opts.Capacity += lanes[i].Capacity
+	}
+
+	switch {
+	case opts.Key != 0:
+		key = uintptr(opts.Key)
+	case opts.Path != "":
+		key, err = shm.Ftok(opts.Path, 1)
+	default:
+		key = DefaultKey
+	}
+	return
+}
 
-// Message 要写入的信息
+// Message 要写入的信息，只有module和msg的旧接口，见Record
 type Message struct {
 	Module     string
 	Msg        string
+	Level      int // 日志级别，和log.Level一致，用来选通道
 	RetryTimes int // 重试的次数，0不重试，小于0直接丢弃
 }
 
-const maxMessageLength = 2000
+// 共享内存段的格式
+const (
+	segmentMagic   = 0x474f4c52 // "RLOG"
+	segmentVersion = 8
+)
+
+// segmentHeader 共享内存开头的段头，写日志的进程和agent打开时都要检查
+type segmentHeader struct {
+	magic      uint32 // 最后写，不为0表示段头已经初始化
+	version    uint32
+	capacity   uint64 // 所有通道的字节数之和
+	maxMessage uint64
+	pid        uint32 // 创建队列的进程
+	lanes      uint32 // 通道数
+	created    int64  // 创建时间，unix纳秒
+	futex      uint32 // 每发布一条有读进程在等的日志加1，读的进程在上面futex等待
+	waiters    uint32 // 在futex上等待的读进程数，为0时写的进程不用唤醒
+
+	// 队列满时各处理方式的计数
+	droppedNewest uint64
+	overwritten   uint64
+	blockTimeouts uint64
+	spilled       uint64
+
+	corrupted uint64 // 读的进程跳过的损坏记录
+	abandoned uint64 // 读的进程跳过的写进程没有发布的记录
+
+	lane [maxLanes]laneHeader
+}
+
+// 段头的大小，按64字节对齐
+const headerSize = (int(unsafe.Sizeof(segmentHeader{})) + 63) &^ 63
+
+// SegmentInfo 共享内存段的信息
+type SegmentInfo struct {
+	Version    int
+	Capacity   int
+	MaxMessage int
+	Lanes      []Lane
+	Pid        int       // 创建队列的进程
+	Created    time.Time // 创建时间
+}
+
+// 记录头，8字节，低32位为记录内容的长度，写的进程占住还没发布时为占的字节数，不带标志
+const (
+	recordCommit = 1 << 63 // 写完了，可以读
+	recordWrap   = 1 << 62 // 回绕标记，长度为到缓冲区末尾的字节数，读的时候跳过
+	recordClaim  = 1 << 61 // 正在被读
+	recordLength = 1<<32 - 1
+)
+
+// align 按8字节对齐，记录头要能原子读写
+func align(n int) int {
+	return (n + 7) &^ 7
+}
+
+// recordSize 内容长度为n的记录占的字节数
+func recordSize(n int) int {
+	return 8 + align(n)
+}
 
 // LogQuery log队列，写程序一直往里写，agent一直从里面读
+// 共享内存的布局为：段头+各通道的环形缓冲区依次排列，段头里有每个通道的writeIndex和readIndex
+//
+// 写位置和读位置只增不减，对capacity取余为在缓冲区里的偏移，每条记录为8字节的记录头加内容，按8字节对齐。
+// 写的进程用cas占住写位置到写位置+记录长度这段空间后写内容，写完再原子地写记录头发布；
+// 缓冲区末尾放不下时先占住到末尾的空间写一个回绕标记，再从缓冲区开头写。
+// 读的进程只读已发布的记录，先用cas在记录头上标记正在读，读完把这条记录清零再推进读位置，
+// 所以写的进程拿到的空间总是全零的，没写完的记录头为0，读的进程不会读到写了一半的记录
 type LogQuery struct {
-	writeIndex int32
-	readIndex  int32
-	message    [maxQueryLength][maxMessageLength]byte
+	hdr        *segmentHeader
+	lanes      []*lane // MinLevel从低到高
+	capacity   uint64
+	maxMessage int
+
+	// 队列满时的处理，只影响本进程
+	overflowPolicy int
+	blockTimeout   time.Duration
+	spillPath      string
+	spillFormat    LineFormat
+	spillMu        sync.Mutex
+	spillFile      *os.File
+
+	// 跳过的损坏记录写到的文件
+	quarantinePath string
+	quarantineMu   sync.Mutex
+	quarantineFile *os.File
+}
+
+// queueSize 队列占的共享内存大小
+func queueSize(lanes []Lane) int {
+	size := headerSize
+	for _, lane := range lanes {
+		size += lane.Capacity
+	}
+	return size
+}
+
+// newLogQuery 在mem上建队列，mem的长度为queueSize(lanes)，不初始化
+func newLogQuery(mem []byte, lanes []Lane, maxMessage int) *LogQuery {
+	hdr := (*segmentHeader)(unsafe.Pointer(&mem[0]))
+	q := &LogQuery{
+		hdr:        hdr,
+		maxMessage: maxMessage,
+	}
+	off := headerSize
+	for i, lane := range lanes {
+		q.lanes = append(q.lanes, newLane(&hdr.lane[i], lane.MinLevel, maxMessage, mem[off:off+lane.Capacity]))
+		q.capacity += uint64(lane.Capacity)
+		off += lane.Capacity
+	}
+	return q
+}
+
+// reset 清空队列，重写段头
+func (q *LogQuery) reset() {
+	atomic.StoreUint32(&q.hdr.magic, 0)
+	atomic.StoreUint32(&q.hdr.waiters, 0)
+	atomic.StoreUint64(&q.hdr.droppedNewest, 0)
+	atomic.StoreUint64(&q.hdr.overwritten, 0)
+	atomic.StoreUint64(&q.hdr.blockTimeouts, 0)
+	atomic.StoreUint64(&q.hdr.spilled, 0)
+	atomic.StoreUint64(&q.hdr.corrupted, 0)
+	atomic.StoreUint64(&q.hdr.abandoned, 0)
+	for _, l := range q.lanes {
+		l.reset()
+	}
+
+	q.hdr.version = segmentVersion
+	q.hdr.capacity = q.capacity
+	q.hdr.maxMessage = uint64(q.maxMessage)
+	q.hdr.lanes = uint32(len(q.lanes))
+	q.hdr.pid = uint32(os.Getpid())
+	q.hdr.created = time.Now().UnixNano()
+	atomic.StoreUint32(&q.hdr.magic, segmentMagic)
+}
+
+// validate 检查已经初始化的段头和设置是否一致
+func (q *LogQuery) validate() error {
+	h := q.hdr
+	if magic := atomic.LoadUint32(&h.magic); magic != segmentMagic {
+		return fmt.Errorf("rlog: bad segment magic %#x, not a rlog queue or created by an older version", magic)
+	}
+	if h.version != segmentVersion {
+		return fmt.Errorf("rlog: segment version %d, expect %d", h.version, segmentVersion)
+	}
+	if h.capacity != q.capacity || h.maxMessage != uint64(q.maxMessage) {
+		return fmt.Errorf("rlog: segment created by pid %d with capacity %d max message %d, expect capacity %d max message %d",
+			h.pid, h.capacity, h.maxMessage, q.capacity, q.maxMessage)
+	}
+	if lanes := q.info().Lanes; !sameLanes(lanes, q.lanes) {
+		return fmt.Errorf("rlog: segment created by pid %d with lanes %v, expect %v", h.pid, lanes, q.laneOptions())
+	}
+	return nil
+}
+
+func sameLanes(lanes []Lane, ls []*lane) bool {
+	if len(lanes) != len(ls) {
+		return false
+	}
+	for i, l := range ls {
+		if lanes[i].MinLevel != l.minLevel || lanes[i].Capacity != int(l.capacity) {
+			return false
+		}
+	}
+	return true
 }
 
-var query = &LogQuery{
-	writeIndex: 0,
-	readIndex:  0,
+// laneOptions 本进程的通道设置
+func (q *LogQuery) laneOptions() []Lane {
+	lanes := make([]Lane, len(q.lanes))
+	for i, l := range q.lanes {
+		lanes[i] = Lane{MinLevel: l.minLevel, Capacity: int(l.capacity)}
+	}
+	return lanes
+}
+
+// info 段头的信息
+func (q *LogQuery) info() *SegmentInfo {
+	info := &SegmentInfo{
+		Version:    int(q.hdr.version),
+		Capacity:   int(q.hdr.capacity),
+		MaxMessage: int(q.hdr.maxMessage),
+		Pid:        int(q.hdr.pid),
+		Created:    time.Unix(0, q.hdr.created),
+	}
+	for i := 0; i < int(q.hdr.lanes) && i < maxLanes; i++ {
+		l := &q.hdr.lane[i]
+		info.Lanes = append(info.Lanes, Lane{MinLevel: int(l.minLevel), Capacity: int(l.capacity)})
+	}
+	return info
 }
 
-// Init 初始化队列
-func Init() error {
-	var key uintptr = 2
-	var size uintptr = 4 + 4 + maxMessageLength*maxQueryLength
-	shmid, err := shm.Shmget(key, size, shm.IPC_CREATE|0600)
-	if err != 0 {
+// lane 级别为level的日志写到的通道：MinLevel不高于level的通道里最高的，都高于level时为最低的
+func (q *LogQuery) lane(level int) *lane {
+	for i := len(q.lanes) - 1; i > 0; i-- {
+		if level >= q.lanes[i].minLevel {
+			return q.lanes[i]
+		}
+	}
+	return q.lanes[0]
+}
+
+var query *LogQuery
+
+// Init 打开队列，不存在时创建并初始化，已经存在的要和设置一致，opts为nil时用默认设置
+func Init(opts *Options) error {
+	o, key, err := opts.normalize()
+	if err != nil {
 		return err
 	}
+	overflow, err := newOverflow(o.Overflow)
+	if err != nil {
+		return err
+	}
+	if overflow == overflowSpill && o.SpillPath == "" {
+		return fmt.Errorf("rlog: spill overflow without spill path")
+	}
 
-	addr, err := shm.Shmat(shmid)
-	if err != 0 {
+	// 只有创建段的进程初始化队列，写日志的进程和agent重启时不会清掉队列里的日志
+	size := uintptr(queueSize(o.Lanes))
+	created := true
+	shmid, errno := shm.Shmget(key, size, shm.IPC_CREATE|shm.IPC_EXCL|0600)
+	if errno == syscall.EEXIST {
+		if shmid, created, err = openSegment(key, size); err != nil {
+			return err
+		}
+	} else if errno != 0 {
+		return fmt.Errorf("rlog: shmget key %#x size %d: %v", key, size, errno)
+	}
+
+	mem, err := shm.Attach(shmid, size)
+	if err != nil {
 		return err
 	}
 
-	query = (*LogQuery)(unsafe.Pointer(uintptr(addr)))
-	query.readIndex = 0
-	query.writeIndex = 0
+	q := newLogQuery(mem, o.Lanes, o.MaxMessage)
+	q.overflowPolicy, q.blockTimeout, q.spillPath = overflow, o.BlockTimeout, o.SpillPath
+	if o.SpillFormat != nil {
+		q.spillFormat = *o.SpillFormat
+	}
+	q.quarantinePath = o.QuarantinePath
+	if created || !q.waitReady() {
+		q.reset()
+	} else if err := q.validate(); err != nil {
+		shm.Shmdt(uintptr(unsafe.Pointer(&mem[0])))
+		return err
+	}
+	query = q
 
 	return nil
 }
 
+// openSegment 打开已经存在的段，是旧版本留下的没有进程attach的段时删掉重建
+func openSegment(key, size uintptr) (shmid uintptr, created bool, err error) {
+	shmid, errno := shm.Shmget(key, 0, 0600)
+	if errno != 0 {
+		return 0, false, fmt.Errorf("rlog: shmget key %#x: %v", key, errno)
+	}
+	ds, errno := shm.Stat(shmid)
+	if errno != 0 {
+		return 0, false, fmt.Errorf("rlog: stat segment key %#x: %v", key, errno)
+	}
+
+	if ds.Segsz == legacySize {
+		if ds.Nattch != 0 {
+			return 0, false, fmt.Errorf("rlog: segment key %#x is used by %d processes of an older version", key, ds.Nattch)
+		}
+		shm.Shmctl(shmid, shm.IPC_RMID, nil)
+		shmid, errno = shm.Shmget(key, size, shm.IPC_CREATE|shm.IPC_EXCL|0600)
+		created = true
+	} else {
+		// 已经有的段比要的小时返回EINVAL
+		shmid, errno = shm.Shmget(key, size, 0600)
+	}
+	if errno != 0 {
+		return 0, false, fmt.Errorf("rlog: shmget key %#x size %d: %v", key, size, errno)
+	}
+	return shmid, created, nil
+}
+
+// 等创建段的进程初始化队列的时间，超时认为它初始化到一半就退出了
+const readyTimeout = time.Second
+
+// waitReady 等段头初始化好，超时返回false
+func (q *LogQuery) waitReady() bool {
+	deadline := time.Now().Add(readyTimeout)
+	for atomic.LoadUint32(&q.hdr.magic) == 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// Info 返回队列所在共享内存段的信息，没有Init时返回nil
+func Info() *SegmentInfo {
+	if query == nil {
+		return nil
+	}
+	return query.info()
+}
+
 // Empty 判断队列是否空
 func Empty() bool {
-	return query.empty()
+	return query == nil || query.empty()
 }
 
-// Full 判断队列是否满
+// Full 判断队列是否满，所有通道都写不进最长的日志时为满
 func Full() bool {
-	return query.full()
+	return query != nil && query.full()
 }
 
-// Write 往队列里写信息
+// Write 往队列里写信息，时间、pid和tid为当前的
 func Write(message *Message) error {
+	if query == nil {
+		return ErrorNotInit
+	}
 	return query.write(message)
 }
 
-// Read 从队列里读信息
-func Read() (module string, message string, err error) {
-	return query.read()
+// WriteRecord 往队列里写一条日志，没有设置的时间、pid和tid用当前的，cas失败时重试retryTimes次，小于0直接丢弃
+func WriteRecord(r *Record, retryTimes int) error {
+	if query == nil {
+		return ErrorNotInit
+	}
+	return query.writeRecord(r, retryTimes)
 }
 
-func (q *LogQuery) empty() bool {
-	writeIndex := atomic.LoadInt32(&q.writeIndex)
-	readIndex := atomic.LoadInt32(&q.readIndex)
-	return writeIndex == readIndex
+// Read 从队列里读一条日志，先读高级别的通道
+func Read() (*Record, error) {
+	if query == nil {
+		return nil, ErrorNotInit
+	}
+	return query.readRecord()
 }
 
-func (q *LogQuery) full() bool {
-	writeIndex := atomic.LoadInt32(&q.writeIndex)
-	readIndex := atomic.LoadInt32(&q.readIndex)
-	nextIndex := (writeIndex + maxQueryLength + 1) % maxQueryLength
-	return nextIndex == readIndex
+// ReadMessage 从队列里读信息，只有module和msg的旧接口，见Read
+func ReadMessage() (module string, message string, err error) {
+	if query == nil {
+		err = ErrorNotInit
+		return
+	}
+	return query.read()
 }
 
-func (q *LogQuery) write(message *Message) error {
-	if message.RetryTimes < 0 {
-		return ErrorRetryError
+// ReadWait 从队列里读一条日志，队列空时等到有日志，超时返回ErrorQueryEmpty，timeout小于等于0时一直等
+func ReadWait(timeout time.Duration) (*Record, error) {
+	if query == nil {
+		return nil, ErrorNotInit
 	}
+	return query.readWait(timeout)
+}
 
-	writeIndex := atomic.LoadInt32(&q.writeIndex)
-	readIndex := atomic.LoadInt32(&q.readIndex)
+// ReadMessageWait 同ReadWait，只有module和msg的旧接口
+func ReadMessageWait(timeout time.Duration) (module string, message string, err error) {
+	if query == nil {
+		err = ErrorNotInit
+		return
+	}
+	r, err := query.readWait(timeout)
+	if err != nil {
+		return
+	}
+	return r.Module, r.Msg, nil
+}
 
-	index := (writeIndex + maxQueryLength + 1) % maxQueryLength
-	if index == readIndex {
-		// 队列满了
-		// fmt.Printf("query full, writeIndex: %d, readIndex: %d, index: %d\n", writeIndex, readIndex, index)
-		return ErrorQueryFull
+func (q *LogQuery) empty() bool {
+	for _, l := range q.lanes {
+		if !l.empty() {
+			return false
+		}
 	}
+	return true
+}
 
-	if !atomic.CompareAndSwapInt32(&q.writeIndex, writeIndex, index) {
-		// 写失败，重试一次咯
-		message.RetryTimes--
-		// fmt.Printf("cas errro, writeIndex: %d, index: %d\n", writeIndex, index)
-		return q.write(message)
+func (q *LogQuery) full() bool {
+	for _, l := range q.lanes {
+		if !l.full(q.maxMessage) {
+			return false
+		}
 	}
+	return true
+}
 
-	moduleLen := uint16(len(message.Module))
-	msgLen := uint16(len(message.Msg))
+func (q *LogQuery) write(message *Message) error {
+	return q.writeRecord(&Record{Module: message.Module, Msg: message.Msg, Level: message.Level}, message.RetryTimes)
+}
 
-	if 2+2+moduleLen+msgLen > maxMessageLength {
-		message.Msg = message.Msg[:maxMessageLength-moduleLen-4]
-		msgLen = uint16(len(message.Msg))
+func (q *LogQuery) writeRecord(record *Record, retry int) error {
+	if retry < 0 {
+		return ErrorRetryError
 	}
 
-	// 写入格式为：
-	// 2字节module长度+2字节msg长度+module+msg
+	r := *record
+	r.fill()
+	full := r // spill时不截断
+	r.trim(q.maxMessage)
+
+	n := crcSize + r.size()
+	size := uint64(recordSize(n))
+	l := q.lane(r.Level)
+	pos, err := l.reserve(size, &retry)
+	if err == ErrorQueryFull {
+		pos, err = q.overflow(l, size, &retry, &full)
+	}
+	if err == errSpilled {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-	binary.LittleEndian.PutUint16(q.message[writeIndex][0:2], moduleLen)
-	binary.LittleEndian.PutUint16(q.message[writeIndex][2:4], msgLen)
-	copy(q.message[writeIndex][4:4+moduleLen], message.Module)
-	copy(q.message[writeIndex][4+moduleLen:], message.Msg)
+	off := pos%l.capacity + 8
+	r.encodeBody(l.data[off : off+uint64(n)])
 
+	// 写完才发布
+	atomic.StoreUint64(l.header(pos), recordCommit|uint64(n))
+	q.wake()
 	return nil
+}
 
+// wake 有读进程在等时唤醒，读进程只在队列空时等待，所以只有队列由空变为非空时才要系统调用
+func (q *LogQuery) wake() {
+	if atomic.LoadUint32(&q.hdr.waiters) == 0 {
+		return
+	}
+	atomic.AddUint32(&q.hdr.futex, 1)
+	shm.FutexWake(&q.hdr.futex, math.MaxInt32)
 }
 
-func (q *LogQuery) read() (module string, message string, err error) {
-	writeIndex := atomic.LoadInt32(&q.writeIndex)
-	readIndex := atomic.LoadInt32(&q.readIndex)
+// readWait 队列空时等到有日志或者超时
+func (q *LogQuery) readWait(timeout time.Duration) (r *Record, err error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		r, err = q.readRecord()
+		if err != ErrorQueryEmpty {
+			return
+		}
+
+		// 最多等abandonTimeout，写的进程占住空间后退出时也能跳过
+		wait := abandonTimeout
+		if timeout > 0 {
+			if wait = time.Until(deadline); wait <= 0 {
+				return
+			}
+			if wait > abandonTimeout {
+				wait = abandonTimeout
+			}
+		}
+
+		// 先登记再检查一次，写的进程发布后看到waiters不为0就会改futex并唤醒
+		seq := atomic.LoadUint32(&q.hdr.futex)
+		atomic.AddUint32(&q.hdr.waiters, 1)
+		if q.empty() {
+			shm.FutexWait(&q.hdr.futex, seq, wait)
+		}
+		atomic.AddUint32(&q.hdr.waiters, ^uint32(0))
+	}
+}
 
-	if readIndex == writeIndex {
-		err = ErrorQueryEmpty
-		// fmt.Printf("query empty, readIndex: %d, writeIndex: %d\n", readIndex, writeIndex)
+func (q *LogQuery) read() (module string, message string, err error) {
+	r, err := q.readRecord()
+	if err != nil {
 		return
 	}
+	return r.Module, r.Msg, nil
+}
 
-	index := (readIndex + maxQueryLength + 1) % maxQueryLength
-	if !atomic.CompareAndSwapInt32(&q.readIndex, readIndex, index) {
-		// 读失败
-		err = ErrorCasError
-		// fmt.Printf("cas error, readIndex: %d, index: %d\n", readIndex, index)
+// readRecord 从高级别的通道往低级别的读，高级别的通道读空了才读低级别的
+// 跳过损坏或者没有发布的记录时分别计数并返回ErrorCorrupt
+func (q *LogQuery) readRecord() (r *Record, err error) {
+	for i := len(q.lanes) - 1; i >= 0; i-- {
+		r, err = q.lanes[i].read()
+		if ce, ok := err.(*corruptError); ok {
+			if ce.abandoned {
+				atomic.AddUint64(&q.hdr.abandoned, 1)
+			} else {
+				atomic.AddUint64(&q.hdr.corrupted, 1)
+			}
+			q.quarantine(q.lanes[i], ce)
+			return nil, ErrorCorrupt
+		}
+		if err != ErrorQueryEmpty {
+			return
+		}
+	}
+	return
+}
+
+// quarantine 把损坏记录的原始内容追加到quarantinePath，写不了时忽略
+func (q *LogQuery) quarantine(l *lane, ce *corruptError) {
+	if q.quarantinePath == "" {
 		return
 	}
 
-	moduleLen := binary.LittleEndian.Uint16(q.message[readIndex][0:2])
-	msgLen := binary.LittleEndian.Uint16(q.message[readIndex][2:4])
-	module = string(q.message[readIndex][4 : 4+moduleLen])
-	message = string(q.message[readIndex][4+moduleLen : 4+moduleLen+msgLen])
+	q.quarantineMu.Lock()
+	defer q.quarantineMu.Unlock()
 
-	return
+	if q.quarantineFile == nil {
+		f, err := os.OpenFile(q.quarantinePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return
+		}
+		q.quarantineFile = f
+	}
+	fmt.Fprintf(q.quarantineFile, "%s lane %d pos %d %s: %x\n",
+		time.Now().Format(time.RFC3339Nano), l.minLevel, ce.pos, ce.reason, ce.data)
 }
@@ -7,31 +7,54 @@ package rlog
 
 import (
 	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 
+	"github.com/plexsec/utils/log/shm"
 	"github.com/stretchr/testify/assert"
 )
 
+func newTestQuery(capacity, maxMessage int) *LogQuery {
+	lanes := []Lane{{Capacity: capacity}}
+	mem := make([]byte, queueSize(lanes))
+	q := newLogQuery(mem, lanes, maxMessage)
+	q.reset()
+	return q
+}
+
 func TestEmpty(t *testing.T) {
-	q := &LogQuery{
-		writeIndex: 0,
-		readIndex:  0,
-	}
+	q := newTestQuery(1024, 64)
 	assert.True(t, q.empty(), "should be empty")
+	assert.Nil(t, q.write(&Message{Module: "test", Msg: "TestEmpty"}))
+	assert.False(t, q.empty(), "should not be empty")
 }
 
 func TestFull(t *testing.T) {
-	q := &LogQuery{
-		writeIndex: 998,
-		readIndex:  0,
+	q := newTestQuery(1024, 64)
+	size := recordSize(crcSize + (&Record{Module: "test", Msg: "TestFull"}).size())
+	for i := 0; i < (1024-recordSize(crcSize+64))/size; i++ {
+		assert.Nil(t, q.write(&Message{Module: "test", Msg: "TestFull"}))
 	}
 	assert.False(t, q.full(), "should not be full")
-	q.writeIndex++
+	assert.Nil(t, q.write(&Message{Module: "test", Msg: "TestFull"}))
 	assert.True(t, q.full(), "should be full")
+	q.read()
+	assert.False(t, q.full(), "should not be full")
 }
 
 func TestRetryError(t *testing.T) {
-	q := &LogQuery{}
+	q := newTestQuery(1024, 64)
 	msg := &Message{
 		Module:     "test",
 		Msg:        "TestRetryError",
@@ -41,19 +64,21 @@ func TestRetryError(t *testing.T) {
 }
 
 func TestWriteFullFailed(t *testing.T) {
-	q := &LogQuery{
-		writeIndex: 999,
-	}
+	q := newTestQuery(1024, 64)
 	msg := &Message{
 		Module:     "test",
 		Msg:        "TestWrite",
 		RetryTimes: 0,
 	}
+	size := recordSize(crcSize + (&Record{Module: msg.Module, Msg: msg.Msg}).size())
+	for i := 0; i < 1024/size; i++ {
+		assert.Nil(t, q.write(msg), "should write success")
+	}
 	assert.Equal(t, ErrorQueryFull, q.write(msg), "write full should be failed")
 }
 
 func TestWrite(t *testing.T) {
-	q := &LogQuery{}
+	q := newTestQuery(1024, 64)
 	msg := &Message{
 		Module:     "test",
 		Msg:        "TestWrite",
@@ -61,67 +86,735 @@ func TestWrite(t *testing.T) {
 	}
 	assert.Nil(t, q.write(msg), "should write success")
 
-	var message [maxMessageLength]byte
-	binary.LittleEndian.PutUint16(message[0:2], 4)
-	binary.LittleEndian.PutUint16(message[2:4], 9)
-	copy(message[4:8], msg.Module)
-	copy(message[8:], msg.Msg)
-	assert.Equal(t, message, q.message[0], "message should be euqal")
-	assert.Equal(t, int32(1), q.writeIndex, "writeIndex should be 1")
-	assert.Equal(t, int32(0), q.readIndex, "readIndex should be 0")
+	n := crcSize + (&Record{Module: msg.Module, Msg: msg.Msg}).size()
+	assert.Equal(t, recordCommit|uint64(n), binary.LittleEndian.Uint64(q.lanes[0].data[0:8]))
+	r, err := decodeBody(q.lanes[0].data[8 : 8+n])
+	assert.Nil(t, err)
+	assert.Equal(t, "test", r.Module)
+	assert.Equal(t, "TestWrite", r.Msg)
+	assert.Equal(t, os.Getpid(), r.Pid)
+	assert.True(t, time.Since(r.Time) < time.Minute)
+	assert.Equal(t, uint64(recordSize(n)), *q.lanes[0].writeIndex, "writeIndex should be record size")
+	assert.Equal(t, uint64(0), *q.lanes[0].readIndex, "readIndex should be 0")
 }
 
 func TestReadEmpty(t *testing.T) {
-	q := &LogQuery{}
+	q := newTestQuery(1024, 64)
 	module, message, err := q.read()
 	assert.Equal(t, "", module, "module should be empty")
 	assert.Equal(t, "", message, "message should be empty")
 	assert.Equal(t, ErrorQueryEmpty, err, "err should be equal")
+
+	// 占住了还没写完的记录读不到
+	r := &Record{Module: "test"}
+	n := crcSize + r.size()
+	pos, _ := q.lanes[0].reserve(uint64(recordSize(n)), new(int))
+	r.encodeBody(q.lanes[0].data[pos+8 : pos+8+uint64(n)])
+	_, _, err = q.read()
+	assert.Equal(t, ErrorQueryEmpty, err, "uncommitted record should not be read")
+	atomic.StoreUint64(q.lanes[0].header(pos), recordCommit|uint64(n))
+	_, _, err = q.read()
+	assert.Nil(t, err)
 }
 
 func TestRead(t *testing.T) {
-	q := &LogQuery{}
-	module := "test"
-	message := "message"
-	binary.LittleEndian.PutUint16(q.message[q.writeIndex][0:2], 4)
-	binary.LittleEndian.PutUint16(q.message[q.writeIndex][2:4], 7)
-	copy(q.message[q.writeIndex][4:8], module)
-	copy(q.message[q.writeIndex][8:], message)
-
-	q.writeIndex++
+	q := newTestQuery(1024, 64)
+	assert.Nil(t, q.write(&Message{Module: "test", Msg: "message"}))
 
 	actModule, actMessage, err := q.read()
-	assert.Equal(t, module, actModule, "module should be equal")
-	assert.Equal(t, message, actMessage, "message should be equal")
+	assert.Equal(t, "test", actModule, "module should be equal")
+	assert.Equal(t, "message", actMessage, "message should be equal")
 	assert.Nil(t, err, "err should be nil")
-	assert.Equal(t, int32(1), q.readIndex, "")
-	assert.Equal(t, int32(1), q.writeIndex, "")
+	size := recordSize(crcSize + (&Record{Module: "test", Msg: "message"}).size())
+	assert.Equal(t, uint64(size), *q.lanes[0].readIndex, "")
+	assert.Equal(t, uint64(size), *q.lanes[0].writeIndex, "")
+	assert.Equal(t, make([]byte, size), q.lanes[0].data[:size], "record should be cleared")
 }
 
 func TestTrimMessage(t *testing.T) {
-	q := LogQuery {
+	q := newTestQuery(DefaultCapacity, 2000)
+	msg := &Message{
+		Module: "test",
+		Msg:    strings.Repeat("hello", 400),
+	}
+	assert.Nil(t, q.write(msg), "should write success")
+
+	module, message, err := q.read()
+	assert.Nil(t, err)
+	assert.Equal(t, "test", module)
+	assert.True(t, strings.HasPrefix(msg.Msg, message))
+	assert.Equal(t, 2000, (&Record{Module: module, Msg: message}).size())
+}
+
+func TestWrap(t *testing.T) {
+	q := newTestQuery(512, 100)
+	var expect []string
+	for i := 0; i < 100; i++ {
+		msg := strings.Repeat(string(rune('a'+i%26)), i%70)
+		assert.Nil(t, q.write(&Message{Module: "wrap", Msg: msg}), "write %d", i)
+		expect = append(expect, msg)
+		if i%3 == 0 {
+			continue
+		}
+		for !q.empty() {
+			_, message, err := q.read()
+			assert.Nil(t, err)
+			assert.Equal(t, expect[0], message)
+			expect = expect[1:]
+		}
+	}
+	_, message, err := q.read()
+	assert.Nil(t, err)
+	assert.Equal(t, expect, []string{message})
+
+	// 队列空的时候末尾放不下，写回绕标记后从开头写
+	q = newTestQuery(256, 100)
+	*q.lanes[0].readIndex = 240
+	*q.lanes[0].writeIndex = 240
+	assert.Nil(t, q.write(&Message{Module: "wrap", Msg: strings.Repeat("x", 70)}))
+	size := recordSize(crcSize + (&Record{Module: "wrap", Msg: strings.Repeat("x", 70)}).size())
+	assert.Equal(t, uint64(256+size), *q.lanes[0].writeIndex)
+	module, message, err := q.read()
+	assert.Nil(t, err)
+	assert.Equal(t, "wrap", module)
+	assert.Equal(t, strings.Repeat("x", 70), message)
+	assert.True(t, q.empty())
+}
+
+func TestOptions(t *testing.T) {
+	opts, key, err := (*Options)(nil).normalize()
+	assert.Nil(t, err)
+	assert.Equal(t, uintptr(DefaultKey), key)
+	assert.Equal(t, DefaultCapacity, opts.Capacity)
+	assert.Equal(t, DefaultMaxMessage, opts.MaxMessage)
+
+	o := &Options{Path: t.TempDir(), Capacity: 4096, MaxMessage: 100}
+	_, key, err = o.normalize()
+	assert.Nil(t, err)
+	assert.NotEqual(t, uintptr(DefaultKey), key)
+
+	for _, env := range o.Environ() {
+		kv := strings.SplitN(env, "=", 2)
+		t.Setenv(kv[0], kv[1])
+	}
+	assert.Equal(t, o, OptionsFromEnv())
+
+	_, _, err = (&Options{Capacity: 1024, MaxMessage: 1000}).normalize()
+	assert.NotNil(t, err)
+	_, _, err = (&Options{Path: "/no/such/path"}).normalize()
+	assert.NotNil(t, err)
+
+	// 通道按MinLevel排序，Capacity为各通道之和
+	o = &Options{Key: 3, MaxMessage: 100, Lanes: []Lane{{MinLevel: 5, Capacity: 1024}, {Capacity: 4093}}}
+	opts, _, err = o.normalize()
+	assert.Nil(t, err)
+	assert.Equal(t, []Lane{{Capacity: 4096}, {MinLevel: 5, Capacity: 1024}}, opts.Lanes)
+	assert.Equal(t, 5120, opts.Capacity)
+	for _, env := range o.Environ() {
+		kv := strings.SplitN(env, "=", 2)
+		t.Setenv(kv[0], kv[1])
+	}
+	assert.Equal(t, o.Lanes, OptionsFromEnv().Lanes)
+
+	_, _, err = (&Options{Lanes: []Lane{{Capacity: 1 << 20}, {Capacity: 1 << 20}}}).normalize()
+	assert.NotNil(t, err, "duplicate min level")
+}
+
+// 多进程压测的设置
+const (
+	stressProducers = 4
+	stressRecords   = 5000
+	stressCapacity  = 16 * 1024
+	stressMax       = 256
+)
+
+var stressLanes = []Lane{{Capacity: stressCapacity}}
+
+// stressMessage 第i条日志，长度随i变化，读到的内容不对说明读到了写了一半的槽
+func stressMessage(producer string, i int) string {
+	return fmt.Sprintf("%s-%d-", producer, i) + strings.Repeat(string(rune('a'+i%26)), i%200)
+}
+
+// TestStressProducer 多进程压测里写日志的子进程，由TestMultiProcess启动
+func TestStressProducer(t *testing.T) {
+	shmid := os.Getenv("RLOG_STRESS_SHMID")
+	if shmid == "" {
+		t.Skip("run by TestMultiProcess")
+	}
+	id, _ := strconv.Atoi(shmid)
+	producer := os.Getenv("RLOG_STRESS_PRODUCER")
+
+	mem, err := shm.Attach(uintptr(id), uintptr(queueSize(stressLanes)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := newLogQuery(mem, stressLanes, stressMax)
+
+	for i := 0; i < stressRecords; {
+		r := &Record{Module: producer, Msg: stressMessage(producer, i), Fields: []Field{{Key: "i", Value: strconv.Itoa(i)}}}
+		switch err := q.writeRecord(r, 10); err {
+		case nil:
+			i++
+		case ErrorQueryFull, ErrorRetryError:
+			runtime.Gosched()
+		default:
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMultiProcess(t *testing.T) {
+	size := uintptr(queueSize(stressLanes))
+	shmid, errno := shm.Shmget(shm.IPC_PRIVATE, size, shm.IPC_CREATE|0600)
+	if errno != 0 {
+		t.Skip("shmget:", errno)
+	}
+	defer shm.Shmctl(shmid, shm.IPC_RMID, nil)
+
+	mem, err := shm.Attach(shmid, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := newLogQuery(mem, stressLanes, stressMax)
+	q.reset()
+
+	done := make(chan error, stressProducers)
+	for i := 0; i < stressProducers; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestStressProducer$")
+		cmd.Env = append(os.Environ(),
+			fmt.Sprintf("RLOG_STRESS_SHMID=%d", shmid),
+			fmt.Sprintf("RLOG_STRESS_PRODUCER=p%d", i))
+		out := &strings.Builder{}
+		cmd.Stdout, cmd.Stderr = out, out
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			err := cmd.Wait()
+			if err != nil {
+				err = fmt.Errorf("%v: %s", err, out.String())
+			}
+			done <- err
+		}()
+	}
+
+	next := make(map[string]int, stressProducers)
+	total, exited := 0, 0
+	deadline := time.Now().Add(time.Minute)
+	for total < stressProducers*stressRecords && time.Now().Before(deadline) {
+		r, err := q.readWait(10 * time.Millisecond)
+		switch err {
+		case nil:
+			module := r.Module
+			if r.Msg != stressMessage(module, next[module]) || r.Fields[0].Value != strconv.Itoa(next[module]) {
+				t.Fatalf("torn or lost record from %s, expect %d: %q", module, next[module], r.Msg)
+			}
+			assert.NotEqual(t, os.Getpid(), r.Pid)
+			next[module]++
+			total++
+		case ErrorQueryEmpty:
+			select {
+			case err := <-done:
+				assert.Nil(t, err)
+				exited++
+			default:
+			}
+		}
+	}
+	for ; exited < stressProducers; exited++ {
+		assert.Nil(t, <-done)
+	}
+
+	assert.Equal(t, stressProducers*stressRecords, total)
+	assert.True(t, q.empty())
+}
+
+func TestSegmentHeader(t *testing.T) {
+	lanes := []Lane{{Capacity: 1024}}
+	mem := make([]byte, queueSize(lanes))
+	q := newLogQuery(mem, lanes, 64)
+	assert.NotNil(t, q.validate(), "uninitialized segment")
+
+	q.reset()
+	assert.Nil(t, q.validate())
+	info := q.info()
+	assert.Equal(t, segmentVersion, info.Version)
+	assert.Equal(t, 1024, info.Capacity)
+	assert.Equal(t, 64, info.MaxMessage)
+	assert.Equal(t, os.Getpid(), info.Pid)
+	assert.True(t, time.Since(info.Created) < time.Minute)
+
+	assert.NotNil(t, newLogQuery(mem, lanes, 128).validate(), "max message mismatch")
+	q.hdr.version++
+	assert.NotNil(t, q.validate(), "version mismatch")
+}
+
+// initTestSegment 用临时目录生成key创建队列，测试结束时删掉
+func initTestSegment(t *testing.T) *Options {
+	opts := &Options{Path: t.TempDir(), Capacity: 4096, MaxMessage: 100}
+	_, key, _ := opts.normalize()
+	if err := Init(opts); err != nil {
+		t.Skip("shm:", err)
+	}
+	t.Cleanup(func() {
+		if shmid, errno := shm.Shmget(key, 0, 0); errno == 0 {
+			shm.Shmctl(shmid, shm.IPC_RMID, nil)
+		}
+	})
+	return opts
+}
+
+func TestInitMismatch(t *testing.T) {
+	opts := initTestSegment(t)
+	assert.Equal(t, os.Getpid(), Info().Pid)
+
+	assert.Nil(t, Init(opts))
+	err := Init(&Options{Path: opts.Path, Capacity: 4096, MaxMessage: 200})
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "max message"), err.Error())
+}
+
+func TestInitAttach(t *testing.T) {
+	opts := initTestSegment(t)
+	created := Info().Created
+	assert.Nil(t, Write(&Message{Module: "test", Msg: "queued"}))
+
+	// 重新打开时不清掉队列
+	assert.Nil(t, Init(opts))
+	assert.Equal(t, created, Info().Created)
+	r, err := Read()
+	assert.Nil(t, err)
+	assert.Equal(t, "test", r.Module)
+	assert.Equal(t, "queued", r.Msg)
+	assert.Equal(t, os.Getpid(), r.Pid)
+
+	assert.Nil(t, Write(&Message{Module: "test", Msg: "legacy"}))
+	module, message, err := ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "test", module)
+	assert.Equal(t, "legacy", message)
+}
+
+func TestReadWait(t *testing.T) {
+	q := newTestQuery(1024, 64)
+
+	start := time.Now()
+	_, err := q.readWait(50 * time.Millisecond)
+	assert.Equal(t, ErrorQueryEmpty, err)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		q.write(&Message{Module: "test", Msg: "wake"})
+	}()
+	start = time.Now()
+	r, err := q.readWait(10 * time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "wake", r.Msg)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, uint32(0), atomic.LoadUint32(&q.hdr.waiters))
+
+	// 没有读进程在等时写日志不改futex
+	futex := atomic.LoadUint32(&q.hdr.futex)
+	q.write(&Message{Module: "test", Msg: "no waiter"})
+	assert.Equal(t, futex, atomic.LoadUint32(&q.hdr.futex))
+}
+
+// fillQuery 写到写不进去为止
+func fillQuery(q *LogQuery) {
+	for q.write(&Message{Module: "test", Msg: "fill"}) == nil {
+	}
+}
+
+func TestOverflowDrop(t *testing.T) {
+	q := newTestQuery(1024, 64)
+	fillQuery(q)
+	assert.Equal(t, ErrorQueryFull, q.write(&Message{Module: "test", Msg: "dropped"}))
+	assert.Equal(t, uint64(2), q.stats().DroppedNewest)
+}
+
+func TestOverflowOverwrite(t *testing.T) {
+	q := newTestQuery(1024, 64)
+	q.overflowPolicy = overflowOverwrite
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, q.write(&Message{Module: "test", Msg: fmt.Sprintf("line %d", i)}))
+	}
+	stats := q.stats()
+	assert.True(t, stats.Overwritten > 0)
+	assert.Equal(t, uint64(0), stats.DroppedNewest)
+
+	var last string
+	n := 0
+	for !q.empty() {
+		_, message, err := q.read()
+		assert.Nil(t, err)
+		last = message
+		n++
+	}
+	assert.Equal(t, "line 99", last)
+	assert.Equal(t, 100, n+int(stats.Overwritten))
+}
+
+func TestOverflowBlock(t *testing.T) {
+	q := newTestQuery(1024, 64)
+	q.overflowPolicy = overflowBlock
+	q.blockTimeout = 50 * time.Millisecond
+	fillQuery(q)
+	assert.Equal(t, uint64(1), q.stats().BlockTimeouts)
+
+	q.blockTimeout = 10 * time.Second
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		q.read()
+		q.read()
+	}()
+	start := time.Now()
+	assert.Nil(t, q.write(&Message{Module: "test", Msg: "unblocked"}))
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, uint64(1), q.stats().BlockTimeouts)
+}
+
+func TestOverflowSpill(t *testing.T) {
+	q := newTestQuery(1024, 64)
+	q.overflowPolicy = overflowSpill
+	q.spillPath = filepath.Join(t.TempDir(), "spill.log")
+	q.spillFormat = LineFormat{Loc: time.UTC}
+	for !q.full() {
+		assert.Nil(t, q.write(&Message{Module: "test", Msg: "fill"}))
 	}
-	msg := &Message {
+	// spill的和agent发的格式一样，不截断
+	msg := strings.Repeat("x", 100)
+	for q.hdr.spilled == 0 {
+		assert.Nil(t, q.writeRecord(&Record{
+			Time:   time.Date(2022, 2, 16, 8, 30, 0, 0, time.UTC),
+			Level:  4,
+			Module: "test",
+			File:   "main.go",
+			Line:   7,
+			Func:   "main",
+			Msg:    msg,
+			Fields: []Field{{Key: "k", Value: "v"}},
+		}, 0))
+	}
+	defer q.spillFile.Close()
+
+	assert.Equal(t, uint64(0), q.stats().DroppedNewest)
+	assert.Equal(t, uint64(1), q.stats().Spilled)
+	content, err := ioutil.ReadFile(q.spillPath)
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("%d|2022-02-16 08:30:00.000000|WARN|test|main.go:7 main|%s k=v\n", os.Getpid(), msg),
+		string(content))
+}
+
+func TestLanes(t *testing.T) {
+	lanes := []Lane{{Capacity: 1024}, {MinLevel: 5, Capacity: 1024}}
+	mem := make([]byte, queueSize(lanes))
+	q := newLogQuery(mem, lanes, 64)
+	q.reset()
+	assert.Equal(t, lanes, q.info().Lanes)
+
+	// 低级别的日志写满了自己的通道，高级别的还能写
+	fillQuery(q)
+	assert.False(t, q.full())
+	assert.Nil(t, q.write(&Message{Module: "test", Msg: "error", Level: 5}))
+	assert.Nil(t, q.write(&Message{Module: "test", Msg: "fatal", Level: 7}))
+
+	// 先读高级别的通道
+	_, message, err := q.read()
+	assert.Nil(t, err)
+	assert.Equal(t, "error", message)
+	_, message, err = q.read()
+	assert.Nil(t, err)
+	assert.Equal(t, "fatal", message)
+	_, message, err = q.read()
+	assert.Nil(t, err)
+	assert.Equal(t, "fill", message)
+
+	other := []Lane{{Capacity: 1024}, {MinLevel: 4, Capacity: 1024}}
+	assert.NotNil(t, newLogQuery(mem, other, 64).validate(), "lanes mismatch")
+}
+
+func TestRecord(t *testing.T) {
+	q := newTestQuery(4096, 256)
+	r := &Record{
+		Time:   time.Unix(1500000000, 123456789),
+		Level:  5,
+		Pid:    123,
+		Tid:    456,
 		Module: "test",
+		File:   "rlog_test.go",
+		Line:   42,
+		Func:   "TestRecord",
+		Msg:    "message",
+		Fields: []Field{{Key: "user", Value: "alice"}, {Key: "empty"}},
 	}
-	i := 0
-	for i < 400 {
-		msg.Msg += "hello"
-		i++
+	assert.Nil(t, q.writeRecord(r, 0))
+	got, err := q.readRecord()
+	assert.Nil(t, err)
+	assert.True(t, r.Time.Equal(got.Time))
+	got.Time = r.Time
+	assert.Equal(t, r, got)
+
+	// 没有设置的时间、pid和tid用当前的
+	assert.Nil(t, q.writeRecord(&Record{Module: "test"}, 0))
+	got, err = q.readRecord()
+	assert.Nil(t, err)
+	assert.Equal(t, os.Getpid(), got.Pid)
+	assert.NotEqual(t, 0, got.Tid)
+	assert.True(t, time.Since(got.Time) < time.Minute)
+
+	// 先截msg，还放不下时去掉字段和调用位置，最后截module
+	long := *r
+	long.Msg = strings.Repeat("m", 300)
+	long.trim(256)
+	assert.Equal(t, 256, long.size())
+	assert.Equal(t, r.Fields, long.Fields)
+	long.Module = strings.Repeat("x", 300)
+	long.trim(256)
+	assert.Equal(t, 256, long.size())
+	assert.Equal(t, "", long.Msg)
+	assert.Nil(t, long.Fields)
+
+	b := make([]byte, r.size())
+	r.encode(b)
+	for i := 0; i < len(b); i++ {
+		_, err = decodeRecord(b[:i])
+		assert.Equal(t, errBadRecord, err, "truncated at %d", i)
 	}
-	assert.Nil(t, q.write(msg), "should write success")
-	expect := ""
-	i = 0
-	for i < 398 {
-		expect += "hello"
-		i++
-	}
-	expect += "he"
-	// assert.Equal(t, expect, string(q.message[0][:]), "should be equal")
-	var message [maxMessageLength]byte
-	binary.LittleEndian.PutUint16(message[0:2], 4)
-	binary.LittleEndian.PutUint16(message[2:4], 1992)
-	copy(message[4:8], msg.Module)
-	copy(message[8:], expect)
-	assert.Equal(t, message, q.message[0], "")
+	_, err = decodeRecord(append(b, 0))
+	assert.Equal(t, errBadRecord, err, "trailing bytes")
+}
+
+func TestCorrupt(t *testing.T) {
+	q := newTestQuery(1024, 64)
+	q.quarantinePath = filepath.Join(t.TempDir(), "quarantine.log")
+	l := q.lanes[0]
+	write := func(msg string) uint64 {
+		pos := atomic.LoadUint64(l.writeIndex)
+		assert.Nil(t, q.write(&Message{Module: "test", Msg: msg}))
+		return pos
+	}
+	read := func(expect string) {
+		_, message, err := q.read()
+		assert.Nil(t, err)
+		assert.Equal(t, expect, message)
+	}
+
+	// crc不对的记录跳过
+	write("one")
+	pos := write("two")
+	write("three")
+	l.data[pos%l.capacity+20]++
+	read("one")
+	_, _, err := q.read()
+	assert.Equal(t, ErrorCorrupt, err)
+	read("three")
+
+	// 长度不对时找下一条完好的记录
+	pos = write("four")
+	write("five")
+	atomic.StoreUint64(l.header(pos), recordCommit|1000)
+	_, _, err = q.read()
+	assert.Equal(t, ErrorCorrupt, err)
+	read("five")
+
+	// 覆盖旧日志的写进程不处理损坏的记录
+	pos = write("six")
+	atomic.StoreUint64(l.header(pos), recordCommit|3)
+	ok, _ := l.discardOldest()
+	assert.False(t, ok)
+	_, _, err = q.read()
+	assert.Equal(t, ErrorCorrupt, err)
+
+	// 写的进程占住空间后退出了
+	l.reserve(uint64(recordSize(crcSize+(&Record{Module: "test", Msg: "lost"}).size())), new(int))
+	write("seven")
+	_, _, err = q.read()
+	assert.Equal(t, ErrorQueryEmpty, err)
+	l.stuckSince = l.stuckSince.Add(-2 * abandonTimeout)
+	_, _, err = q.read()
+	assert.Equal(t, ErrorCorrupt, err)
+	read("seven")
+	assert.True(t, q.empty())
+
+	assert.Equal(t, uint64(3), q.stats().Corrupted)
+	assert.Equal(t, uint64(1), q.stats().Abandoned)
+	defer q.quarantineFile.Close()
+	content, err := ioutil.ReadFile(q.quarantinePath)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Equal(t, 4, len(lines))
+	assert.True(t, strings.Contains(lines[0], "bad checksum"), lines[0])
+	assert.True(t, strings.Contains(lines[3], "abandoned"), lines[3])
+}
+
+func TestLineFormat(t *testing.T) {
+	r := &Record{
+		Time:   time.Date(2022, 2, 16, 8, 30, 0, 120000000, time.UTC),
+		Level:  5,
+		Pid:    123,
+		Module: "proto",
+		File:   "main.go",
+		Line:   42,
+		Func:   "parse",
+		Msg:    "packet a|b",
+		Fields: []Field{{Key: "len", Value: "2"}, {Key: "hex", Value: "0102"}},
+	}
+
+	// 列数固定，内容里有|也在最后一列
+	f := &LineFormat{Loc: time.UTC}
+	assert.Equal(t, "123|2022-02-16 08:30:00.120000|ERROR|proto|main.go:42 parse|packet a|b len=2 hex=0102\n",
+		string(f.AppendLine(nil, r)))
+
+	f = &LineFormat{Host: "host1", Unit: time.Millisecond}
+	assert.Equal(t, "host1|1645000200120|ERROR|proto|main.go:42 parse|packet a|b len=2 hex=0102\n",
+		string(f.AppendLine(nil, r)))
+
+	// 时间格式通过环境变量传给agent
+	f = &LineFormat{Layout: time.RFC3339, Loc: time.UTC}
+	for _, kv := range f.Environ() {
+		i := strings.IndexByte(kv, '=')
+		t.Setenv(kv[:i], kv[i+1:])
+	}
+	t.Setenv("HOSTNAME", "")
+	assert.Equal(t, "123|2022-02-16T08:30:00Z|ERROR|proto|main.go:42 parse|packet a|b len=2 hex=0102\n",
+		string(LineFormatFromEnv().AppendLine(nil, r)))
+}
+
+func TestAbandonedInFlight(t *testing.T) {
+	q := newTestQuery(1024, 64)
+	l := q.lanes[0]
+	r := &Record{Module: "test", Msg: "in flight"}
+	r.fill()
+	n := crcSize + r.size()
+	size := uint64(recordSize(n))
+	retry := 0
+
+	// 写的进程占住空间后退出，后面的写进程还没写完，再后面的已经发布
+	abandoned, err := l.reserve(size, &retry)
+	assert.Nil(t, err)
+	inFlight, err := l.reserve(size, &retry)
+	assert.Nil(t, err)
+	assert.Nil(t, q.write(&Message{Module: "test", Msg: "committed"}))
+
+	read := func() (string, error) {
+		_, message, err := q.read()
+		return message, err
+	}
+	_, err = read()
+	assert.Equal(t, ErrorQueryEmpty, err)
+	l.stuckSince = l.stuckSince.Add(-2 * abandonTimeout)
+	_, err = read()
+	assert.Equal(t, ErrorCorrupt, err)
+	assert.Equal(t, abandoned+size, atomic.LoadUint64(l.readIndex))
+
+	// 还没写完的记录不能被跳过，写完后按顺序读出来
+	_, err = read()
+	assert.Equal(t, ErrorQueryEmpty, err)
+	off := inFlight%l.capacity + 8
+	r.encodeBody(l.data[off : off+uint64(n)])
+	atomic.StoreUint64(l.header(inFlight), recordCommit|uint64(n))
+	msg, err := read()
+	assert.Nil(t, err)
+	assert.Equal(t, "in flight", msg)
+	msg, err = read()
+	assert.Nil(t, err)
+	assert.Equal(t, "committed", msg)
+	assert.Equal(t, uint64(1), q.stats().Abandoned)
+
+	// 写记录头之前就退出的，跳到下一条占住的记录
+	abandoned, _ = l.reserve(size, &retry)
+	atomic.StoreUint64(l.header(abandoned), 0)
+	inFlight, _ = l.reserve(size, &retry)
+	_, err = read()
+	assert.Equal(t, ErrorQueryEmpty, err)
+	l.stuckSince = l.stuckSince.Add(-2 * abandonTimeout)
+	_, err = read()
+	assert.Equal(t, ErrorCorrupt, err)
+	assert.Equal(t, inFlight, atomic.LoadUint64(l.readIndex))
+}
+
+func FuzzDecodeBody(f *testing.F) {
+	for _, r := range []*Record{
+		{},
+		{Time: time.Unix(1500000000, 0), Level: 3, Pid: 1, Tid: 2, Module: "test", Msg: "message"},
+		{Module: "test", File: "rlog_test.go", Line: 1 << 20, Func: "FuzzDecodeBody", Fields: []Field{{Key: "k", Value: "v"}}},
+	} {
+		b := make([]byte, crcSize+r.size())
+		r.encodeBody(b)
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r, err := decodeBody(b)
+		if err != nil {
+			return
+		}
+		// 解得出来的再编码要和原来一样
+		out := make([]byte, crcSize+r.size())
+		r.encodeBody(out)
+		assert.Equal(t, b, out)
+
+		r, err = decodeRecord(b[crcSize:])
+		assert.Nil(t, err)
+		assert.Equal(t, len(b)-crcSize, r.size())
+	})
+}
+
+// FuzzRead 缓冲区里是任意内容时读不会越界，读位置不会超过写位置
+func FuzzRead(f *testing.F) {
+	q := newTestQuery(512, 64)
+	q.write(&Message{Module: "test", Msg: "message"})
+	q.write(&Message{Module: "test", Msg: "another"})
+	f.Add(append([]byte(nil), q.lanes[0].data...), uint16(0))
+	f.Add(append([]byte(nil), q.lanes[0].data...), uint16(480))
+
+	f.Fuzz(func(t *testing.T, data []byte, start uint16) {
+		q := newTestQuery(512, 64)
+		l := q.lanes[0]
+		copy(l.data, data)
+		pos := uint64(start) &^ 7
+		*l.readIndex, *l.writeIndex = pos, pos+uint64(align(len(data)))
+		if *l.writeIndex > pos+l.capacity {
+			*l.writeIndex = pos + l.capacity
+		}
+
+		for i := 0; i < 1000; i++ {
+			if _, err := q.readRecord(); err == ErrorQueryEmpty || err == ErrorCasError {
+				break
+			}
+			assert.True(t, *l.readIndex <= *l.writeIndex)
+		}
+	})
+}
+
+func TestLegacySegment(t *testing.T) {
+	// 旧的agent用key 2，不会attach到新格式的段
+	assert.NotEqual(t, legacyKey, DefaultKey)
+
+	opts := &Options{Path: t.TempDir(), Capacity: 4096, MaxMessage: 100}
+	_, key, _ := opts.normalize()
+	shmid, errno := shm.Shmget(key, legacySize, shm.IPC_CREATE|0600)
+	if errno != 0 {
+		t.Skip("shmget:", errno)
+	}
+	t.Cleanup(func() {
+		if shmid, errno := shm.Shmget(key, 0, 0); errno == 0 {
+			shm.Shmctl(shmid, shm.IPC_RMID, nil)
+		}
+	})
+
+	// 还有旧进程attach时不删
+	mem, err := shm.Attach(shmid, legacySize)
+	assert.Nil(t, err)
+	assert.NotNil(t, Init(opts))
+	shm.Shmdt(uintptr(unsafe.Pointer(&mem[0])))
+
+	// 没有进程attach的旧段删掉重建
+	assert.Nil(t, Init(opts))
+	assert.Equal(t, os.Getpid(), Info().Pid)
+	shmid, _ = shm.Shmget(key, 0, 0)
+	ds, errno := shm.Stat(shmid)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, uint64(queueSize([]Lane{{Capacity: 4096}})), ds.Segsz)
 }
@@ -0,0 +1,158 @@
+package log
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RuleConfig 输出的过滤规则，在级别判断之后按顺序匹配，第一条匹配的规则决定丢弃还是保留
+// 没有规则匹配时按输出的级别判断，keep规则可以保留低于输出级别的日志
+// 如{Action: "drop", Module: "x", MaxLevel: "VERBOSE"}，{Action: "keep", Level: "DEBUG", Message: "auth"}
+type RuleConfig struct {
+	Action   string      // drop或keep
+	Level    interface{} // 最低级别，为空时不限制
+	MaxLevel interface{} // 最高级别，为空时不限制
+	Module   string      // 模块名，为空时不限制
+	File     string      // 文件名，如server.go，为空时不限制
+	Func     string      // 函数名，为空时不限制
+	Message  string      // 日志内容要匹配的正则，为空时不限制
+}
+
+type rule struct {
+	keep     bool
+	level    Level
+	maxLevel Level // OFF表示不限制
+	module   string
+	file     string
+	fn       string
+	message  *regexp.Regexp
+}
+
+// rules 一个输出的过滤规则，创建后不再修改
+type rules []*rule
+
+// newRules 解析过滤规则，有错的规则跳过并返回第一个错误
+func newRules(cfgs []*RuleConfig) (rules, error) {
+	var rs rules
+	var err error
+	for i, cfg := range cfgs {
+		if cfg == nil {
+			continue
+		}
+		r, e := newRule(cfg)
+		if e != nil {
+			if err == nil {
+				err = fmt.Errorf("log rule %d: %v", i, e)
+			}
+			continue
+		}
+		rs = append(rs, r)
+	}
+	return rs, err
+}
+
+func newRule(cfg *RuleConfig) (*rule, error) {
+	r := &rule{
+		level:  VERBOSE,
+		module: cfg.Module,
+		file:   cfg.File,
+		fn:     cfg.Func,
+	}
+
+	switch strings.ToLower(cfg.Action) {
+	case "drop":
+	case "keep":
+		r.keep = true
+	default:
+		return nil, fmt.Errorf("unknown action %q", cfg.Action)
+	}
+
+	if cfg.Level != nil {
+		r.level = newLevel(cfg.Level)
+	}
+	if cfg.MaxLevel != nil {
+		r.maxLevel = newLevel(cfg.MaxLevel)
+	}
+
+	if cfg.Message != "" {
+		re, err := regexp.Compile(cfg.Message)
+		if err != nil {
+			return nil, err
+		}
+		r.message = re
+	}
+	return r, nil
+}
+
+func (r *rule) matchLevel(level Level) bool {
+	return level >= r.level && (r.maxLevel == OFF || level <= r.maxLevel)
+}
+
+func (r *rule) match(e *Entry, msg []byte) bool {
+	if !r.matchLevel(e.Level) {
+		return false
+	}
+	if r.module != "" && r.module != e.Module {
+		return false
+	}
+	if r.file != "" && r.file != e.File {
+		return false
+	}
+	if r.fn != "" && r.fn != e.Func {
+		return false
+	}
+	if r.message != nil && !r.message.Match(msg) {
+		return false
+	}
+	return true
+}
+
+// lowest keep规则里最低的级别，没有keep规则时返回OFF
+func (rs rules) lowest() Level {
+	min := OFF
+	for _, r := range rs {
+		if r.keep && (min == OFF || r.level < min) {
+			min = r.level
+		}
+	}
+	return min
+}
+
+// mayKeep 是否有keep规则可能保留该级别的日志
+func (rs rules) mayKeep(level Level) bool {
+	for _, r := range rs {
+		if r.keep && r.matchLevel(level) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter 按规则判断是否输出，pass为级别判断的结果，没有规则匹配时返回pass
+func (rs rules) filter(pass bool, e *Entry, msg []byte) bool {
+	for _, r := range rs {
+		if r.match(e, msg) {
+			return r.keep
+		}
+	}
+	return pass
+}
+
+// SetStdRules 设置标准输出的过滤规则，见RuleConfig
+func SetStdRules(cfgs []*RuleConfig) error {
+	rs, err := newRules(cfgs)
+	update(func(l *logger) {
+		l.std.rules = rs
+	})
+	return err
+}
+
+// SetRemoteRules 设置远程日志的过滤规则，见RuleConfig
+func SetRemoteRules(cfgs []*RuleConfig) error {
+	rs, err := newRules(cfgs)
+	update(func(l *logger) {
+		l.remote.rules = rs
+	})
+	return err
+}
@@ -0,0 +1,85 @@
+package log
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sampler 一个调用点的采样状态
+type sampler struct {
+	count uint64 // 调用次数
+
+	mu   sync.Mutex
+	last time.Time // Every上次打印的时间，系统时钟时带单调时间，不受改系统时间影响
+}
+
+// 以调用点的pc为key
+var samplers sync.Map // map[uintptr]*sampler
+
+// callSite 取调用Every等函数的地方作为key，skip为调用callSite的函数之上还要跳过的层数
+func callSite(skip int) *sampler {
+	var pcs [1]uintptr
+	runtime.Callers(skip+3, pcs[:])
+	if s, ok := samplers.Load(pcs[0]); ok {
+		return s.(*sampler)
+	}
+	s, _ := samplers.LoadOrStore(pcs[0], &sampler{})
+	return s.(*sampler)
+}
+
+func (s *sampler) every(now time.Time, d time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.last.IsZero() && now.Sub(s.last) < d {
+		return false
+	}
+	s.last = now
+	return true
+}
+
+func (s *sampler) everyN(n int) bool {
+	if n <= 1 {
+		return true
+	}
+	return (atomic.AddUint64(&s.count, 1)-1)%uint64(n) == 0
+}
+
+func (s *sampler) firstN(n int) bool {
+	if atomic.LoadUint64(&s.count) >= uint64(n) {
+		return false
+	}
+	return atomic.AddUint64(&s.count, 1) <= uint64(n)
+}
+
+// Every 同一个调用点每隔d最多打印一次，如log.Every(time.Minute).Warn(...)
+func Every(d time.Duration) Cond {
+	return Cond{on: callSite(0).every(load().clock.Now(), d)}
+}
+
+// EveryN 同一个调用点每n次打印一次，第一次总是打印
+func EveryN(n int) Cond {
+	return Cond{on: callSite(0).everyN(n)}
+}
+
+// FirstN 同一个调用点只打印前n次
+func FirstN(n int) Cond {
+	return Cond{on: callSite(0).firstN(n)}
+}
+
+// Every 同一个调用点每隔d最多打印一次
+func (l *Logger) Every(d time.Duration) Cond {
+	return Cond{on: callSite(0).every(load().clock.Now(), d), module: l.module}
+}
+
+// EveryN 同一个调用点每n次打印一次，第一次总是打印
+func (l *Logger) EveryN(n int) Cond {
+	return Cond{on: callSite(0).everyN(n), module: l.module}
+}
+
+// FirstN 同一个调用点只打印前n次
+func (l *Logger) FirstN(n int) Cond {
+	return Cond{on: callSite(0).firstN(n), module: l.module}
+}
@@ -0,0 +1,33 @@
+package shm
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// 不带FUTEX_PRIVATE_FLAG，共享内存里的futex可以跨进程等待和唤醒
+const (
+	futexWait = 0
+	futexWake = 1
+)
+
+// FutexWait *addr等于val时睡眠，直到被FutexWake唤醒或者超时，timeout小于等于0时一直等
+// 返回EAGAIN表示*addr已经不等于val，ETIMEDOUT表示超时，EINTR表示被信号打断
+func FutexWait(addr *uint32, val uint32, timeout time.Duration) syscall.Errno {
+	var ts *syscall.Timespec
+	if timeout > 0 {
+		t := syscall.NsecToTimespec(int64(timeout))
+		ts = &t
+	}
+	_, _, err := syscall.Syscall6(syscall.SYS_FUTEX, uintptr(unsafe.Pointer(addr)), futexWait,
+		uintptr(val), uintptr(unsafe.Pointer(ts)), 0, 0)
+	return err
+}
+
+// FutexWake 唤醒最多n个在addr上等待的进程，返回唤醒的个数
+func FutexWake(addr *uint32, n int) (int, syscall.Errno) {
+	r, _, err := syscall.Syscall6(syscall.SYS_FUTEX, uintptr(unsafe.Pointer(addr)), futexWake,
+		uintptr(n), 0, 0, 0)
+	return int(r), err
+}
@@ -2,13 +2,35 @@ package shm
 
 import (
 	"syscall"
+	"unsafe"
 )
 
 const (
 	// IPC_CREATE create if key is nonexistent
 	IPC_CREATE = 00001000
+	// IPC_EXCL fail if key exists
+	IPC_EXCL = 00002000
+	// IPC_PRIVATE key for a new private segment
+	IPC_PRIVATE = 0
+	// IPC_RMID remove identifier
+	IPC_RMID = 0
+	// IPC_STAT get shmid_ds
+	IPC_STAT = 2
 )
 
+// ShmidDs Shmctl IPC_STAT取到的段信息，同linux 64位的shmid64_ds
+type ShmidDs struct {
+	Perm   [48]byte // ipc64_perm
+	Segsz  uint64   // 段的字节数
+	Atime  int64
+	Dtime  int64
+	Ctime  int64
+	Cpid   int32
+	Lpid   int32
+	Nattch uint64 // attach的进程数
+	_      [2]uint64
+}
+
 // Shmget 创建shmid
 // 参数参见unix的系统调用shmget函数
 // 创建一个读写的空间:shmflg = IPC_CREATE|0600
@@ -29,3 +51,35 @@ func Shmdt(shmid uintptr) syscall.Errno {
 	_, _, err := syscall.Syscall(syscall.SYS_SHMDT, shmid, 0, 0)
 	return err
 }
+
+// Shmctl 参见unix的系统调用shmctl函数，buf可以为nil
+func Shmctl(shmid, cmd uintptr, buf unsafe.Pointer) syscall.Errno {
+	_, _, err := syscall.Syscall(syscall.SYS_SHMCTL, shmid, cmd, uintptr(buf))
+	return err
+}
+
+// Stat 取段的信息
+func Stat(shmid uintptr) (*ShmidDs, syscall.Errno) {
+	ds := &ShmidDs{}
+	return ds, Shmctl(shmid, IPC_STAT, unsafe.Pointer(ds))
+}
+
+// Attach attach到shmid，返回长度为size的共享内存
+func Attach(shmid, size uintptr) ([]byte, error) {
+	addr, err := Shmat(shmid)
+	if err != 0 {
+		return nil, err
+	}
+	// addr是内核映射的地址，不归go管理，转换成指针不会被gc移动
+	p := *(*unsafe.Pointer)(unsafe.Pointer(&addr))
+	return unsafe.Slice((*byte)(p), size), nil
+}
+
+// Ftok 用文件的inode和设备号生成ipc的key，同unix的ftok函数
+func Ftok(path string, id int) (uintptr, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, err
+	}
+	return uintptr(uint32(st.Ino&0xffff) | uint32(st.Dev&0xff)<<16 | uint32(id&0xff)<<24), nil
+}
@@ -0,0 +1,206 @@
+package log
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Cond 有条件的日志，条件不成立时什么都不做，输出时还要满足各输出的级别
+// V(n)的日志对级别写成"V3"的输出，n不超过3时不看级别
+type Cond struct {
+	on     bool
+	module string
+	v      bool // V(n)的条件
+	n      int
+}
+
+// Enabled 条件是否成立
+func (c Cond) Enabled() bool {
+	return c.on
+}
+
+// Fatal 条件成立且大于等于FATAL时打印
+func (c Cond) Fatal(format string, v ...interface{}) {
+	c.output(FATAL, format, v)
+}
+
+// Critical 条件成立且大于等于CRITICAL时打印
+func (c Cond) Critical(format string, v ...interface{}) {
+	c.output(CRITICAL, format, v)
+}
+
+// Error 条件成立且大于等于ERROR时打印
+func (c Cond) Error(format string, v ...interface{}) {
+	c.output(ERROR, format, v)
+}
+
+// Warn 条件成立且大于等于WARN时打印
+func (c Cond) Warn(format string, v ...interface{}) {
+	c.output(WARN, format, v)
+}
+
+// Info 条件成立且大于等于INFO时打印
+func (c Cond) Info(format string, v ...interface{}) {
+	c.output(INFO, format, v)
+}
+
+// Debug 条件成立且大于等于DEBUG时打印
+func (c Cond) Debug(format string, v ...interface{}) {
+	c.output(DEBUG, format, v)
+}
+
+// Verbose 条件成立且大于等于VERBOSE时打印
+func (c Cond) Verbose(format string, v ...interface{}) {
+	c.output(VERBOSE, format, v)
+}
+
+// output 条件成立时输出，V(n)的日志由输出的详细程度决定是否不看级别
+func (c Cond) output(level Level, format string, v []interface{}) {
+	if !c.on {
+		return
+	}
+
+	l := load()
+	if level < l.minLevel && !c.v {
+		return
+	}
+
+	write(l, c.module, level, 1, &message{format: format, args: v, cond: c.v, v: c.n})
+}
+
+// V 详细程度不超过当前设置时才打印，模块单独设置了的用模块的设置
+// 如log.V(2).Debug(...)，在SetVerbosity(2)或以上时才输出
+func V(n int) Cond {
+	return Cond{on: load().verbose("", n), v: true, n: n}
+}
+
+// V 详细程度不超过该模块的设置时才打印
+func (l *Logger) V(n int) Cond {
+	return Cond{on: load().verbose(l.module, n), module: l.module, v: true, n: n}
+}
+
+// verbose 判断详细程度n的日志是否打印
+func (l *logger) verbose(module string, n int) bool {
+	if module == "" {
+		module = l.module
+	}
+	if v, ok := l.vmodule[module]; ok {
+		return n <= v
+	}
+	return n <= l.verbosity
+}
+
+// passV 级别写成"V3"的输出是否不看级别写入V(n)的日志，n不超过3时写入
+// 单独设置了详细程度的模块按模块的设置，V(n)的条件成立就写入
+func (l *logger) passV(module string, verbosity int, m *message) bool {
+	if !m.cond || verbosity < 0 {
+		return false
+	}
+	if _, ok := l.vmodule[module]; ok {
+		return true
+	}
+	return m.v <= verbosity
+}
+
+// acceptV 判断是否有级别写成"V3"的输出要写入V(n)的日志
+func (l *logger) acceptV(module string, level Level, m *message) bool {
+	if !m.cond {
+		return false
+	}
+
+	if l.std.on && l.std.level != OFF && l.passV(module, l.std.verbosity, m) {
+		return true
+	}
+	for _, f := range l.files {
+		if f.on && f.level != OFF && l.passV(module, f.verbosity, m) && f.route(module, level) {
+			return true
+		}
+	}
+	return l.remote.on && l.remote.level != OFF && l.passV(module, l.remote.verbosity, m)
+}
+
+// newVerbosity 解析详细程度，支持整数、"3"和"V3"
+func newVerbosity(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case string:
+		s := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(n)), "V")
+		if i, err := strconv.Atoi(s); err == nil {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// levelVerbosity 级别写成"V3"这种时，返回其中的详细程度
+func levelVerbosity(v interface{}) (int, bool) {
+	s, ok := v.(string)
+	if !ok || !strings.HasPrefix(strings.ToUpper(s), "V") {
+		return 0, false
+	}
+	return newVerbosity(s)
+}
+
+// sinkVerbosity 输出的级别写成"V3"这种时返回其中的详细程度，否则返回-1
+func sinkVerbosity(level interface{}) int {
+	if n, ok := levelVerbosity(level); ok {
+		return n
+	}
+	return -1
+}
+
+// configVerbosity 取配置里的详细程度，没设置时取各输出级别里V3这种写法的最大值
+func configVerbosity(cfg *Config) int {
+	if n, ok := newVerbosity(cfg.Verbosity); ok {
+		return n
+	}
+
+	levels := make([]interface{}, 0, 3+len(cfg.Files))
+	if cfg.Std != nil {
+		levels = append(levels, cfg.Std.Level)
+	}
+	if cfg.File != nil {
+		levels = append(levels, cfg.File.Level)
+	}
+	for _, fc := range cfg.Files {
+		if fc != nil {
+			levels = append(levels, fc.Level)
+		}
+	}
+	if cfg.Remote != nil {
+		levels = append(levels, cfg.Remote.Level)
+	}
+
+	max := 0
+	for _, level := range levels {
+		if n, ok := levelVerbosity(level); ok && n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+// SetVerbosity 设置全局的详细程度，V(n)在n小于等于它时打印
+func SetVerbosity(v interface{}) {
+	n, _ := newVerbosity(v)
+	update(func(l *logger) {
+		l.verbosity = n
+	})
+}
+
+// SetModuleVerbosity 单独设置某个模块的详细程度，v为nil时取消单独设置
+func SetModuleVerbosity(module string, v interface{}) {
+	update(func(l *logger) {
+		vmodule := make(map[string]int, len(l.vmodule)+1)
+		for m, n := range l.vmodule {
+			vmodule[m] = n
+		}
+		if n, ok := newVerbosity(v); ok {
+			vmodule[module] = n
+		} else {
+			delete(vmodule, module)
+		}
+		l.vmodule = vmodule
+	})
+}
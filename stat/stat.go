@@ -56,6 +56,12 @@ type attrWorker struct {
 
 var aw *attrWorker
 
+// 采集函数，每个上报周期上报前调用，用于其他模块上报自身的统计
+var (
+	collectors  []func()
+	collectorSl sync.SpinLock
+)
+
 type Config struct {
 	Addr string
 	Tags []string
@@ -112,6 +118,26 @@ func Init(cfg *Config) {
 	return
 }
 
+// 注册采集函数，只有Init之后才会被调用
+func RegisterCollector(fn func()) {
+	if fn == nil {
+		return
+	}
+	collectorSl.Lock()
+	collectors = append(collectors, fn)
+	collectorSl.Unlock()
+}
+
+func collect() {
+	collectorSl.Lock()
+	fns := collectors
+	collectorSl.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
+
 // 设置属性累加值, 每周期清零
 func Add(attr string, v int64) {
 	add(attr, v, ATTR_TYPE_ACC_PERIOD)
@@ -196,6 +222,8 @@ func loop() {
 				break
 			}
 
+			collect()
+
 			aw.sl.Lock()
 			al := make([]*attrNode, len(aw.nmap))
 			i := 0